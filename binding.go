@@ -0,0 +1,27 @@
+package twofactor
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+var (
+	bindingContextError = errors.New("The binding context cannot be empty")
+)
+
+// NewBindingContext encodes the parts which identify where the encrypted bytes are stored, for instance the table and the account id,
+// so that they can be used as the context of ToBytesWithContext and WithBindingContext.
+// Each part is prefixed by its length, therefore different parts never give the same context: ("ab", "c") differs from ("a", "bc").
+// Sizes:      4      N
+// Format: |part_size|part|...
+func NewBindingContext(parts ...string) []byte {
+	var buffer bytes.Buffer
+	for _, part := range parts {
+		partSizeBytes := bigendian.ToInt(len(part))
+		buffer.Write(partSizeBytes[:])
+		buffer.WriteString(part)
+	}
+	return buffer.Bytes()
+}
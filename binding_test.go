@@ -0,0 +1,85 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+
+	"github.com/sec51/cryptoengine"
+)
+
+func TestBindingContext(t *testing.T) {
+
+	store := cryptoengine.NewMemoryKeyStore()
+	alice, err := NewTOTP("alice@sec51.com", "Sec51", crypto.SHA1, 8, WithKeyStore(store))
+	checkError(t, err)
+	aliceContext := NewBindingContext("users", "1")
+	bobContext := NewBindingContext("users", "2")
+
+	data, err := alice.ToBytesWithContext(aliceContext)
+	checkError(t, err)
+	restored, err := TOTPFromBytesWithContext(data, "Sec51", aliceContext, WithKeyStore(store))
+	checkError(t, err)
+	if restored.Secret() != alice.Secret() {
+		t.Error("Deserialized secret differs from the original one")
+	}
+
+	// the bytes copied to the row of another account, or read without the context, are refused
+	if _, err := TOTPFromBytesWithContext(data, "Sec51", bobContext, WithKeyStore(store)); err != cryptoengine.MessageDecryptionError {
+		t.Errorf("Expected the decryption error with a different context, instead we've got %v\n", err)
+	}
+	if _, err := TOTPFromBytes(data, "Sec51", WithKeyStore(store)); err != cryptoengine.MessageDecryptionError {
+		t.Errorf("Expected the decryption error without the context, instead we've got %v\n", err)
+	}
+
+	// and so are the bytes which are not bound
+	unbound, err := alice.ToBytes()
+	checkError(t, err)
+	if _, err := TOTPFromBytesWithContext(unbound, "Sec51", aliceContext, WithKeyStore(store)); err != cryptoengine.MessageDecryptionError {
+		t.Errorf("Expected the decryption error of the unbound bytes, instead we've got %v\n", err)
+	}
+
+	// the deserialized totp keeps the context
+	data, err = restored.ToBytes()
+	checkError(t, err)
+	_, err = TOTPFromBytes(data, "Sec51", WithKeyStore(store), WithBindingContext(aliceContext))
+	checkError(t, err)
+
+	// the bound bytes are re-encrypted with their context
+	_, err = RotateKey("Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if _, _, err := ReencryptTOTP(data, "Sec51", WithKeyStore(store)); err != cryptoengine.MessageDecryptionError {
+		t.Errorf("Expected the decryption error while re-encrypting without the context, instead we've got %v\n", err)
+	}
+	reencrypted, changed, err := ReencryptTOTP(data, "Sec51", WithKeyStore(store), WithBindingContext(aliceContext))
+	checkError(t, err)
+	if !changed {
+		t.Error("The bytes encrypted with the old key have not been re-encrypted")
+	}
+	_, err = TOTPFromBytesWithContext(reencrypted, "Sec51", aliceContext, WithKeyStore(store))
+	checkError(t, err)
+
+	// the out of band deliveries are bound to the context as well
+	delivery, err := NewOutOfBand("alice@sec51.com", "Sec51", "+41000000000", WithKeyStore(store), WithBindingContext(aliceContext))
+	checkError(t, err)
+	data, err = delivery.ToBytes()
+	checkError(t, err)
+	if _, err := OutOfBandFromBytes(data, "Sec51", WithKeyStore(store), WithBindingContext(bobContext)); err != cryptoengine.MessageDecryptionError {
+		t.Errorf("Expected the decryption error of the delivery with a different context, instead we've got %v\n", err)
+	}
+	_, err = OutOfBandFromBytes(data, "Sec51", WithKeyStore(store), WithBindingContext(aliceContext))
+	checkError(t, err)
+
+	// the parts of the context can not be shifted
+	if bytes.Equal(NewBindingContext("ab", "c"), NewBindingContext("a", "bc")) {
+		t.Error("Different parts give the same binding context")
+	}
+
+	if _, err := alice.ToBytesWithContext(nil); err != bindingContextError {
+		t.Errorf("Expected the binding context error, instead we've got %v\n", err)
+	}
+	if _, err := TOTPFromBytesWithContext(data, "Sec51", []byte{}); err != bindingContextError {
+		t.Errorf("Expected the binding context error, instead we've got %v\n", err)
+	}
+
+}
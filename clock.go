@@ -0,0 +1,20 @@
+package twofactor
+
+import (
+	"time"
+)
+
+// Clock is the source of time used by the Totp to derive the time step counter,
+// to record the last verification and to compute the back-off time.
+// It can be replaced, via the WithClock option, in order to test time dependent behaviours
+// without having to wait for the real time to pass.
+type Clock interface {
+	Now() time.Time
+}
+
+// the default clock, backed by the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
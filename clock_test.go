@@ -0,0 +1,112 @@
+package twofactor
+
+import (
+	"crypto"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually driven clock used to test time dependent behaviours
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestOTPAt(t *testing.T) {
+
+	key, err := hex.DecodeString(sha1KeyHex)
+	checkError(t, err)
+
+	otp, err := makeTOTP(key, "no-reply@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+
+	for index, ts := range timeCounters {
+		token, err := otp.OTPAt(time.Unix(ts, 0))
+		checkError(t, err)
+		if token != sha1TestData[index] {
+			t.Errorf("OTPAt test data, token mismatch. Got %s, expected %s\n", token, sha1TestData[index])
+		}
+	}
+
+}
+
+func TestClockStepBoundaries(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1111111109, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	// the token is generated at the last second of the step
+	token, err := otp.OTP()
+	checkError(t, err)
+
+	// the following step still accepts it, as the previous step token
+	clock.Advance(1 * time.Second)
+	next, err := otp.OTP()
+	checkError(t, err)
+	if next == token {
+		t.Fatal("The token did not change crossing the step boundary")
+	}
+	if err := otp.Validate(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// two steps later the token is not valid anymore
+	if err := otp.ValidateAt(token, clock.Now().Add(60*time.Second)); err == nil {
+		t.Error("Expired token has been accepted")
+	}
+
+}
+
+func TestClockBackoff(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	for i := 0; i < max_failures; i++ {
+		otp.Validate("00000000")
+	}
+
+	if !otp.lastVerificationTime.Equal(clock.Now()) {
+		t.Errorf("lastVerificationTime should come from the clock, instead we've got %s\n", otp.lastVerificationTime)
+	}
+
+	// still locked right before the backoff expires
+	clock.Advance(backoff_minutes * time.Minute)
+	token, err := otp.OTP()
+	checkError(t, err)
+	if err := otp.Validate(token); err != LockDownError {
+		t.Fatalf("Expected the lock down error, instead we've got %v\n", err)
+	}
+
+	// unlocked right after
+	clock.Advance(1 * time.Second)
+	token, err = otp.OTP()
+	checkError(t, err)
+	if err := otp.Validate(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// the clock survives only via the options when deserializing
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, otp.issuer, WithClock(clock))
+	checkError(t, err)
+	if restored.clock != clock {
+		t.Error("The clock option has not been applied to the deserialized TOTP")
+	}
+
+	if _, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(nil)); err == nil {
+		t.Error("A nil clock has been accepted")
+	}
+
+}
@@ -0,0 +1,179 @@
+package twofactor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	code_decimal      = 0                            // serialized type of the decimal codes
+	code_alphabet     = 1                            // serialized type of the codes of an alphabet
+	code_custom       = 255                          // serialized type of a formatter not implemented in this package
+	min_code_length   = 1                            // lower bound of the length of the codes of an alphabet
+	max_code_length   = 10                           // upper bound of the length of the codes, the truncated value has only 31 bits
+	max_alphabet_size = 64                           // upper bound of the amount of characters of an alphabet
+	steam_alphabet    = "23456789BCDFGHJKMNPQRTVWXY" // the alphabet of the Steam Guard codes
+	steam_code_length = 5                            // the length of the Steam Guard codes
+	steam_encoder     = "steam"                      // the encoder parameter of the otpauth URL of the Steam Guard codes
+)
+
+var (
+	codeFormatterError        = errors.New("The code formatter cannot be nil")
+	CodeFormatterMissingError = errors.New("The codes have a custom formatter, it needs to be passed via the WithCodeFormatter option")
+	CodeDigitsError           = errors.New("The digits of the decimal codes must be 6, 7 or 8")
+	CodeLengthError           = errors.New(fmt.Sprintf("The length of the codes must be between %d and %d", min_code_length, max_code_length))
+	CodeAlphabetError         = errors.New(fmt.Sprintf("The alphabet must contain between 2 and %d distinct printable ASCII characters", max_alphabet_size))
+)
+
+// CodeFormatter maps the value extracted from the HMAC to the code displayed on the device
+// The tokens are compared as they are, therefore the formatter defines the exact characters the user needs to type.
+type CodeFormatter interface {
+	// Format returns the code of the value, the 31 bits integer of the dynamic truncation (see RFC 4226 section 5.3)
+	Format(value uint32) string
+
+	// Length returns the amount of characters of the codes
+	Length() int
+}
+
+// NewDecimalFormatter creates the formatter of the zero padded decimal codes of the RFC, this is the default one
+// The digits must be 6, 7 or 8
+func NewDecimalFormatter(digits int) (CodeFormatter, error) {
+	if digits < 6 || digits > 8 {
+		return nil, CodeDigitsError
+	}
+	return decimalFormatter(digits), nil
+}
+
+// NewAlphabetFormatter creates a formatter which writes the value in base len(alphabet), least significant character first,
+// the way the Steam Guard codes are calculated
+// The alphabet must contain between 2 and 64 distinct printable ASCII characters, the length must be between 1 and 10.
+// The codes are not more secure than the decimal ones when the alphabet and the length allow more than 2^31 values.
+func NewAlphabetFormatter(alphabet string, length int) (CodeFormatter, error) {
+	if length < min_code_length || length > max_code_length {
+		return nil, CodeLengthError
+	}
+	if !validAlphabet(alphabet) {
+		return nil, CodeAlphabetError
+	}
+	return &alphabetFormatter{alphabet: alphabet, length: length}, nil
+}
+
+// NewSteamGuardFormatter creates the formatter of the Steam Guard codes: 5 characters of an alphabet of 26 digits and upper case letters
+// The otpauth URL of a Totp with this formatter has the encoder=steam parameter
+func NewSteamGuardFormatter() CodeFormatter {
+	return &alphabetFormatter{alphabet: steam_alphabet, length: steam_code_length}
+}
+
+type decimalFormatter int
+
+func (f decimalFormatter) Format(value uint32) string {
+	return fmt.Sprintf("%0*d", int(f), uint64(value)%pow10(int(f)))
+}
+
+func (f decimalFormatter) Length() int {
+	return int(f)
+}
+
+// returns 10^n, without going through the floating point math.Pow10
+func pow10(n int) uint64 {
+	result := uint64(1)
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result
+}
+
+type alphabetFormatter struct {
+	alphabet string
+	length   int
+}
+
+func (f *alphabetFormatter) Format(value uint32) string {
+	size := uint32(len(f.alphabet))
+	code := make([]byte, f.length)
+	for i := range code {
+		code[i] = f.alphabet[value%size]
+		value /= size
+	}
+	return string(code)
+}
+
+func (f *alphabetFormatter) Length() int {
+	return f.length
+}
+
+// Private function which checks that the alphabet has between 2 and 64 distinct printable ASCII characters
+func validAlphabet(alphabet string) bool {
+	if len(alphabet) < 2 || len(alphabet) > max_alphabet_size {
+		return false
+	}
+	for i := 0; i < len(alphabet); i++ {
+		if alphabet[i] <= ' ' || alphabet[i] > '~' || strings.IndexByte(alphabet[:i], alphabet[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the otpauth URL encoder parameter of the formatter
+// The decimal codes have no encoder, false means that the formatter can't be described by the otpauth URL
+func codeEncoder(formatter CodeFormatter) (string, bool) {
+	switch f := formatter.(type) {
+	case decimalFormatter:
+		return "", true
+	case *alphabetFormatter:
+		if f.alphabet == steam_alphabet && f.length == steam_code_length {
+			return steam_encoder, true
+		}
+	}
+	return "", false
+}
+
+// Returns the serialized representation of the formatter: type and alphabet
+// The length is stored in the digits field. Formatters not implemented in this package can not be serialized and are stored as code_custom
+func codeFormatterToValues(formatter CodeFormatter) (int, string) {
+	switch f := formatter.(type) {
+	case decimalFormatter:
+		return code_decimal, ""
+	case *alphabetFormatter:
+		return code_alphabet, f.alphabet
+	default:
+		return code_custom, ""
+	}
+}
+
+// Returns the formatter from its serialized representation
+// A custom formatter can not be restored, a missingFormatter of the same length is returned instead:
+// the custom formatter needs to be passed again via the WithCodeFormatter option (see checkCodeFormatter)
+func codeFormatterFromValues(codeType int, alphabet string, length int) CodeFormatter {
+	switch codeType {
+	case code_alphabet:
+		return &alphabetFormatter{alphabet: alphabet, length: length}
+	case code_custom:
+		return missingFormatter(length)
+	default:
+		return decimalFormatter(length)
+	}
+}
+
+// missingFormatter stands for a custom formatter which has not been passed again after the deserialization.
+// It keeps the length, so that the Totp serializes back to code_custom, but it never leaves the package:
+// the deserialized Totp is refused unless the formatter is replaced, therefore Format is never called.
+type missingFormatter int
+
+func (f missingFormatter) Format(value uint32) string {
+	return ""
+}
+
+func (f missingFormatter) Length() int {
+	return int(f)
+}
+
+// Private function which checks that the custom formatter of the deserialized Totp has been passed again
+func (otp *Totp) checkCodeFormatter() error {
+	if _, ok := otp.formatter.(missingFormatter); ok {
+		return CodeFormatterMissingError
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upperFormatter is a custom formatter, which is not persisted by ToBytes
+type upperFormatter struct{}
+
+func (upperFormatter) Format(value uint32) string {
+	return strings.Repeat("A", 6)
+}
+
+func (upperFormatter) Length() int {
+	return 6
+}
+
+func TestCodeFormatters(t *testing.T) {
+
+	decimal, err := NewDecimalFormatter(6)
+	checkError(t, err)
+	if code := decimal.Format(1234567890); code != "567890" {
+		t.Errorf("Expected the decimal code 567890, instead we've got %s\n", code)
+	}
+	if code := decimal.Format(42); code != "000042" {
+		t.Errorf("Expected the zero padded decimal code 000042, instead we've got %s\n", code)
+	}
+	if _, err := NewDecimalFormatter(5); err != CodeDigitsError {
+		t.Errorf("Expected the digits error, instead we've got %v\n", err)
+	}
+
+	// the value is written least significant character first
+	steam := NewSteamGuardFormatter()
+	if steam.Length() != 5 {
+		t.Errorf("Expected 5 characters, instead we've got %d\n", steam.Length())
+	}
+	if code := steam.Format(0); code != "22222" {
+		t.Errorf("Expected the Steam Guard code 22222, instead we've got %s\n", code)
+	}
+	if code := steam.Format(26 + 2); code != "43222" {
+		t.Errorf("Expected the Steam Guard code 43222, instead we've got %s\n", code)
+	}
+
+	binary, err := NewAlphabetFormatter("01", 8)
+	checkError(t, err)
+	if code := binary.Format(0xFF05); code != "10100000" {
+		t.Errorf("Expected the binary code 10100000, instead we've got %s\n", code)
+	}
+
+	invalid := []struct {
+		alphabet string
+		length   int
+		err      error
+	}{
+		{"A", 5, CodeAlphabetError},
+		{"ABCA", 5, CodeAlphabetError},
+		{"AB C", 5, CodeAlphabetError},
+		{"ABé", 5, CodeAlphabetError},
+		{strings.Repeat("AB", 40), 5, CodeAlphabetError},
+		{"ABC", 0, CodeLengthError},
+		{"ABC", 11, CodeLengthError},
+	}
+	for _, test := range invalid {
+		if _, err := NewAlphabetFormatter(test.alphabet, test.length); err != test.err {
+			t.Errorf("Alphabet %q of length %d: expected %v, instead we've got %v\n", test.alphabet, test.length, test.err, err)
+		}
+	}
+
+}
+
+func TestSteamGuardTOTP(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Steam", crypto.SHA1, 8, WithClock(clock), WithCodeFormatter(NewSteamGuardFormatter()))
+	checkError(t, err)
+	if otp.digits != 5 {
+		t.Errorf("Expected 5 digits, instead we've got %d\n", otp.digits)
+	}
+
+	token, err := otp.OTP()
+	checkError(t, err)
+	if len(token) != 5 || strings.Trim(token, steam_alphabet) != "" {
+		t.Fatalf("Unexpected Steam Guard token %s\n", token)
+	}
+
+	// the format survives the serialization
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, "Steam", WithClock(clock))
+	checkError(t, err)
+	if restoredToken, _ := restored.OTP(); restoredToken != token {
+		t.Errorf("Expected the deserialized token %s, instead we've got %s\n", token, restoredToken)
+	}
+
+	// and the otpauth URL
+	u, warnings, err := otp.URL(KeyURIProfile)
+	checkError(t, err)
+	if !strings.Contains(u, "&digits=5&") || !strings.HasSuffix(u, "&encoder=steam") {
+		t.Errorf("Unexpected Steam Guard URL %s\n", u)
+	}
+	if len(warnings) != 1 || warnings[0].Parameter != "encoder" {
+		t.Errorf("Expected only the encoder warning, instead we've got %v\n", warnings)
+	}
+	parsed, err := TOTPFromURL(u, WithClock(clock))
+	checkError(t, err)
+	if parsedToken, _ := parsed.OTP(); parsedToken != token {
+		t.Errorf("Expected the token %s from the URL, instead we've got %s\n", token, parsedToken)
+	}
+	if _, warnings, _ := otp.URL(GoogleAuthenticatorProfile); len(warnings) != 1 || warnings[0].Parameter != "encoder" {
+		t.Errorf("Expected only the encoder warning for Google Authenticator, instead we've got %v\n", warnings)
+	}
+	if _, err := TOTPFromURL("otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&encoder=base26"); err != URLEncoderError {
+		t.Errorf("Expected the encoder error, instead we've got %v\n", err)
+	}
+
+	// the validation compares the tokens as they are
+	if err := otp.Validate(strings.ToLower(token)); err == nil {
+		t.Error("The lower case token has been accepted")
+	}
+	if err := otp.Validate(token); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestCustomCodeFormatter(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	hex, err := NewAlphabetFormatter("0123456789ABCDEF", 7)
+	checkError(t, err)
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 6, WithClock(clock), WithCodeFormatter(hex))
+	checkError(t, err)
+	token, err := otp.OTP()
+	checkError(t, err)
+
+	// the alphabets are persisted, but they can't be described by the URL
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, "Sec51", WithClock(clock))
+	checkError(t, err)
+	if restoredToken, _ := restored.OTP(); restoredToken != token {
+		t.Errorf("Expected the deserialized token %s, instead we've got %s\n", token, restoredToken)
+	}
+	if _, _, err := (URLBuilder{Profile: FreeOTPProfile, FailOnWarnings: true}).Build(otp); err == nil {
+		t.Error("The URL of a custom alphabet has been built without warnings")
+	}
+
+	// the custom formatters need to be passed again
+	otp, err = NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 8, WithClock(clock), WithCodeFormatter(upperFormatter{}))
+	checkError(t, err)
+	data, err = otp.ToBytes()
+	checkError(t, err)
+	if _, err := TOTPFromBytes(data, "Sec51", WithClock(clock)); err != CodeFormatterMissingError {
+		t.Errorf("Expected the code formatter missing error, instead we've got %v\n", err)
+	}
+
+	// the migration leaves the current format as it is, it doesn't need the custom formatter
+	migrated, changed, err := MigrateTOTP(data, "Sec51")
+	checkError(t, err)
+	if changed || !bytes.Equal(migrated, data) {
+		t.Error("The current format has been migrated")
+	}
+
+	restored, err = TOTPFromBytes(data, "Sec51", WithClock(clock), WithCodeFormatter(upperFormatter{}))
+	checkError(t, err)
+	if err := restored.Validate("AAAAAA"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithCodeFormatter(nil)); err != codeFormatterError {
+		t.Errorf("Expected the code formatter error, instead we've got %v\n", err)
+	}
+
+}
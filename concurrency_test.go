@@ -0,0 +1,56 @@
+package twofactor
+
+import (
+	"crypto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentValidation(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	token, err := otp.OTP()
+	checkError(t, err)
+
+	// the same token is validated concurrently, while tokens are generated and the state serialized
+	var wg sync.WaitGroup
+	accepted := make(chan bool, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			accepted <- otp.Validate(token) == nil
+		}()
+		go func() {
+			defer wg.Done()
+			if generated, err := otp.OTP(); err != nil || generated != token {
+				t.Errorf("Unexpected concurrent token: %s - %v\n", generated, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := otp.ToBytes(); err != nil {
+				t.Error(err)
+			}
+			otp.LockedUntil()
+		}()
+	}
+	wg.Wait()
+	close(accepted)
+
+	// the token has been accepted exactly once
+	count := 0
+	for ok := range accepted {
+		if ok {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected the token to be accepted once, instead it has been accepted %d times\n", count)
+	}
+
+}
@@ -0,0 +1,289 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+const (
+	delivery_message_type = 3   // this is the message type for the crypto engine when serializing the out of band delivery
+	delivery_step_size    = 300 // the period of the out of band codes, a code is valid between 5 and 10 minutes
+	delivery_digits       = 6   // the digits of the out of band codes
+	resend_interval       = 60  // the seconds to wait between two codes sent
+	max_sends             = 5   // the maximum amount of codes sent within the send window
+	send_window_minutes   = 60  // the send window
+)
+
+var (
+	DeliveryRateLimitError = errors.New("Too many codes have been sent, please wait before requesting a new one.")
+	DeliveryCodeUsedError  = errors.New("The code of the current period has already been used, please wait before requesting a new one.")
+	senderError            = errors.New("The sender cannot be nil")
+)
+
+// OutOfBandMessage is the message handed to the Sender for the delivery
+type OutOfBandMessage struct {
+	Destination string    // the phone number or the email address
+	Issuer      string    // the company which issues the 2FA
+	Account     string    // usually the user email or the account id
+	Code        string    // the one time code
+	ExpiresAt   time.Time // the time after which the code is not accepted anymore
+}
+
+// Text returns the human readable text of the message, used as SMS text or email body
+func (m OutOfBandMessage) Text() string {
+	return fmt.Sprintf("Your %s verification code is: %s\nIt expires at %s.", m.Issuer, m.Code, m.ExpiresAt.UTC().Format("15:04 MST"))
+}
+
+// Sender delivers the out of band code to the user, for instance via SMS or email
+// See SMTPSender and SMSSender for the built-in implementations
+type Sender interface {
+	Send(message OutOfBandMessage) error
+}
+
+// OutOfBand delivers short lived codes to the user via a Sender (SMS, email), for instance when the user lost the device.
+// The codes are generated by a dedicated TOTP, with a random key and a 5 minutes period,
+// therefore the verification follows the same lockout and replay rules as Totp.Validate.
+// The resends are rate limited: one code per minute and at most 5 codes per hour.
+// WARNING: The `OutOfBand` struct should never be instantiated manually!
+// Use the `NewOutOfBand` function
+type OutOfBand struct {
+	otp         *Totp     // the TOTP which generates and validates the codes
+	destination string    // the phone number or the email address
+	lastSent    time.Time // the last time a code has been sent
+	windowStart time.Time // the start of the current send window
+	sends       int       // the amount of codes sent within the current send window
+}
+
+// This function creates a new out of band delivery for the account
+// destination: the phone number or the email address the codes are sent to
+// options: the options of the underlying TOTP, for instance WithClock or WithLockoutPolicy
+func NewOutOfBand(account, issuer, destination string, options ...TotpOption) (*OutOfBand, error) {
+
+	options = append([]TotpOption{WithPeriod(delivery_step_size)}, options...)
+	otp, err := NewTOTP(account, issuer, crypto.SHA1, delivery_digits, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the codes are never in the future
+	if err := WithWindow(otp.windowPast, 0)(otp); err != nil {
+		return nil, err
+	}
+	// the codes are generated by the server clock, there is no drifting device to follow
+	otp.fixedWindow = true
+
+	o := new(OutOfBand)
+	o.otp = otp
+	o.destination = destination
+	return o, nil
+}
+
+// Send generates the current code and delivers it via the sender
+// It returns DeliveryRateLimitError if a code has been sent less than a minute ago,
+// or if 5 codes have already been sent within the last hour, and LockDownError if the verification is locked.
+// After a successful validation, it returns DeliveryCodeUsedError until the next 5 minutes period starts:
+// the code of the current period has been used already, it would be refused as a replay.
+// If the code has been sent, the object needs to be persisted afterwards.
+func (o *OutOfBand) Send(sender Sender) error {
+
+	if o == nil {
+		return initializationFailedError
+	}
+
+	if sender == nil {
+		return senderError
+	}
+
+	now := o.otp.now()
+
+	// sending codes is pointless while the verification is locked
+	if o.otp.lockedAt(now) {
+		return LockDownError
+	}
+
+	// the code of the current step would be a replay
+	if o.otp.usedAt(now) {
+		return DeliveryCodeUsedError
+	}
+
+	// rate limit
+	if !o.lastSent.IsZero() && now.Before(o.lastSent.Add(resend_interval*time.Second)) {
+		return DeliveryRateLimitError
+	}
+	if now.After(o.windowStart.Add(send_window_minutes * time.Minute)) {
+		o.windowStart = now.UTC()
+		o.sends = 0
+	}
+	if o.sends >= max_sends {
+		return DeliveryRateLimitError
+	}
+
+	code, err := o.otp.OTPAt(now)
+	if err != nil {
+		return err
+	}
+
+	// the code is accepted until the end of the last step of the validation window
+	expiresAt := time.Unix(int64(o.otp.stepAt(now, o.otp.windowPast+1)*uint64(o.otp.stepSize)), 0).UTC()
+
+	message := OutOfBandMessage{
+		Destination: o.destination,
+		Issuer:      o.otp.issuer,
+		Account:     o.otp.account,
+		Code:        code,
+		ExpiresAt:   expiresAt,
+	}
+	if err := sender.Send(message); err != nil {
+		return err
+	}
+
+	o.lastSent = now.UTC()
+	o.sends++
+	return nil
+}
+
+// Validate checks the code provided by the user, with the same lockout and replay rules of Totp.Validate
+func (o *OutOfBand) Validate(userCode string) error {
+	if o == nil || o.otp == nil {
+		return initializationFailedError
+	}
+	return o.otp.Validate(userCode)
+}
+
+// LockedUntil returns the time until which the verification is locked, see Totp.LockedUntil
+func (o *OutOfBand) LockedUntil() time.Time {
+	return o.otp.LockedUntil()
+}
+
+// ToBytes serialises the out of band delivery in a byte array
+// Sizes:         4          4              N         8           8          4       4       N
+// Format: |total_bytes|destination_size|destination|last_sent|window_start|sends|totp_size|totp|
+// totp: the TOTP in clear text, in the format described in Totp.ToBytes
+// The data is encrypted using the cryptoengine library, the same way as the Totp,
+// bound to the context set via WithBindingContext, if any
+// With WithGenerationTracker the generation of the totp is incremented and recorded right away, like by Totp.ToBytes
+func (o *OutOfBand) ToBytes() ([]byte, error) {
+
+	if o == nil {
+		return nil, initializationFailedError
+	}
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(o.otp); err != nil {
+		return nil, err
+	}
+
+	otpData, generation, err := o.otp.serializeNextGeneration()
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+
+	totalSize := 4 + 4 + len(o.destination) + 8 + 8 + 4 + 4 + len(otpData)
+	totalSizeBytes := bigendian.ToInt(totalSize)
+	destinationSizeBytes := bigendian.ToInt(len(o.destination))
+	lastSentBytes := bigendian.ToUint64(uint64(o.lastSent.Unix()))
+	windowStartBytes := bigendian.ToUint64(uint64(o.windowStart.Unix()))
+	sendsBytes := bigendian.ToInt(o.sends)
+	otpSizeBytes := bigendian.ToInt(len(otpData))
+
+	// bytes.Buffer writes never return an error, they panic if the buffer becomes too large
+	buffer.Write(totalSizeBytes[:])
+	buffer.Write(destinationSizeBytes[:])
+	buffer.WriteString(o.destination)
+	buffer.Write(lastSentBytes[:])
+	buffer.Write(windowStartBytes[:])
+	buffer.Write(sendsBytes[:])
+	buffer.Write(otpSizeBytes[:])
+	buffer.Write(otpData)
+
+	encrypted, err := encryptBytes(o.otp.currentKeyring(), o.otp.issuer, buffer.String(), delivery_message_type, o.otp.bindingContext)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.otp.generationTracker != nil {
+		if err := o.otp.generationTracker.Observe(o.label(), generation); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// Private function which returns the key of the out of band delivery in the generation tracker,
+// which differs from the one of the Totp of the same account
+func (o *OutOfBand) label() string {
+	return o.otp.label() + "#delivery"
+}
+
+// OutOfBandFromBytes converts a byte array to an out of band delivery object
+// The options, for instance WithClock, are applied to the underlying TOTP after the state has been restored
+// With WithBindingContext the decryption fails if the context differs from the one the bytes were created with
+// With WithGenerationTracker the states older than the last one seen are refused with RollbackError
+func OutOfBandFromBytes(encryptedMessage []byte, issuer string, options ...TotpOption) (*OutOfBand, error) {
+
+	settings, err := settingsFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// decrypt the message
+	data, err := decryptBytes(settings.currentKeyring(), issuer, encryptedMessage, delivery_message_type, settings.bindingContext)
+	if err != nil {
+		return nil, err
+	}
+
+	fr := newFieldReader(data)
+	o := new(OutOfBand)
+
+	totalSize := fr.readInt("total_bytes")
+	fr.check("total_bytes", totalSize == len(data))
+	o.destination = string(fr.readSized("destination"))
+	lastSent := int64(fr.readUint64("last_sent"))
+	windowStart := int64(fr.readUint64("window_start"))
+	o.sends = fr.readInt("sends")
+	otpData := fr.readSized("totp")
+	if err := fr.close(); err != nil {
+		return nil, err
+	}
+
+	// the zero time is serialized with a negative unix time
+	if lastSent > 0 {
+		o.lastSent = time.Unix(lastSent, 0).UTC()
+	}
+	if windowStart > 0 {
+		o.windowStart = time.Unix(windowStart, 0).UTC()
+	}
+
+	o.otp, err = deserializeTOTP(otpData)
+	if err != nil {
+		return nil, err
+	}
+	o.otp.fixedWindow = true
+	o.otp.synchronizeCounter(0)
+
+	if err := applyTotpOptions(o.otp, options); err != nil {
+		return nil, err
+	}
+	if err := o.otp.checkCodeFormatter(); err != nil {
+		return nil, err
+	}
+	if err := o.otp.checkLockoutPolicy(); err != nil {
+		return nil, err
+	}
+
+	// refuse the older states
+	if o.otp.generationTracker != nil {
+		if err := o.otp.generationTracker.Observe(o.label(), o.otp.Generation()); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
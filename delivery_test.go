@@ -0,0 +1,267 @@
+package twofactor
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSender records the messages instead of delivering them
+type fakeSender struct {
+	messages []OutOfBandMessage
+}
+
+func (s *fakeSender) Send(message OutOfBandMessage) error {
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func TestOutOfBand(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	o, err := NewOutOfBand("info@sec51.com", "Sec51", "+41000000000", WithClock(clock))
+	checkError(t, err)
+
+	sender := new(fakeSender)
+	checkError(t, o.Send(sender))
+	if len(sender.messages) != 1 {
+		t.Fatalf("Expected 1 message, instead we've got %d\n", len(sender.messages))
+	}
+	message := sender.messages[0]
+	if message.Destination != "+41000000000" || len(message.Code) != delivery_digits {
+		t.Fatalf("Unexpected message: %+v\n", message)
+	}
+	if !message.ExpiresAt.After(clock.Now().Add(delivery_step_size*time.Second)) || message.ExpiresAt.After(clock.Now().Add(2*delivery_step_size*time.Second)) {
+		t.Errorf("Unexpected expiration time: %s\n", message.ExpiresAt)
+	}
+
+	// the resend is rate limited
+	if err := o.Send(sender); err != DeliveryRateLimitError {
+		t.Errorf("Expected the rate limit error, instead we've got %v\n", err)
+	}
+
+	// the state survives the serialization
+	data, err := o.ToBytes()
+	checkError(t, err)
+	o, err = OutOfBandFromBytes(data, "Sec51", WithClock(clock))
+	checkError(t, err)
+	if err := o.Send(sender); err != DeliveryRateLimitError {
+		t.Errorf("Expected the rate limit error after deserialization, instead we've got %v\n", err)
+	}
+
+	// the code is accepted only once
+	clock.Advance(time.Minute)
+	if err := o.Validate(message.Code); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Validate(message.Code); err == nil {
+		t.Error("The out of band code has been replayed")
+	}
+
+	// the code of the used step is not sent again, it would be refused as a replay
+	clock.Advance(time.Minute)
+	if err := o.Send(sender); err != DeliveryCodeUsedError {
+		t.Errorf("Expected the code used error, instead we've got %v\n", err)
+	}
+	if len(sender.messages) != 1 {
+		t.Fatalf("Expected 1 message, instead we've got %d\n", len(sender.messages))
+	}
+
+	// the code of the next step is sent and accepted
+	clock.Advance(delivery_step_size * time.Second)
+	checkError(t, o.Send(sender))
+	if err := o.Validate(sender.messages[1].Code); err != nil {
+		t.Fatal(err)
+	}
+
+	// the code expires
+	clock.Advance(delivery_step_size * time.Second)
+	checkError(t, o.Send(sender))
+	clock.Advance(2 * delivery_step_size * time.Second)
+	if err := o.Validate(sender.messages[2].Code); err == nil {
+		t.Error("Expired out of band code has been accepted")
+	}
+
+	// out of band and totp bytes can not be mixed
+	if _, err := TOTPFromBytes(data, "Sec51"); err == nil {
+		t.Error("Out of band bytes were parsed as TOTP")
+	}
+
+}
+
+func TestOutOfBandRateLimit(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	o, err := NewOutOfBand("info@sec51.com", "Sec51", "info@sec51.com", WithClock(clock))
+	checkError(t, err)
+
+	sender := new(fakeSender)
+	for i := 0; i < max_sends; i++ {
+		checkError(t, o.Send(sender))
+		clock.Advance(resend_interval * time.Second)
+	}
+	if err := o.Send(sender); err != DeliveryRateLimitError {
+		t.Errorf("Expected the rate limit error, instead we've got %v\n", err)
+	}
+
+	// a new window starts after an hour
+	clock.Advance(send_window_minutes * time.Minute)
+	checkError(t, o.Send(sender))
+
+	// no codes are sent while the verification is locked
+	for i := 0; i < max_failures; i++ {
+		o.Validate("000000")
+	}
+	clock.Advance(resend_interval * time.Second)
+	if err := o.Send(sender); err != LockDownError {
+		t.Errorf("Expected the lock down error, instead we've got %v\n", err)
+	}
+	if len(sender.messages) != max_sends+1 {
+		t.Errorf("Expected %d messages, instead we've got %d\n", max_sends+1, len(sender.messages))
+	}
+
+}
+
+func TestSMSSender(t *testing.T) {
+
+	var form map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "AC123" || password != "token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		form = map[string]string{"To": r.PostForm.Get("To"), "From": r.PostForm.Get("From"), "Body": r.PostForm.Get("Body")}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sender := NewTwilioSender("AC123", "token", "+41111111111")
+	if sender.URL != "https://api.twilio.com/2010-04-01/Accounts/AC123/Messages.json" {
+		t.Errorf("Unexpected Twilio URL: %s\n", sender.URL)
+	}
+	sender.URL = server.URL
+
+	message := OutOfBandMessage{Destination: "+41000000000", Issuer: "Sec51", Code: "123456", ExpiresAt: time.Unix(1234567890, 0)}
+	checkError(t, sender.Send(message))
+	if form["To"] != "+41000000000" || form["From"] != "+41111111111" || !strings.Contains(form["Body"], "123456") {
+		t.Errorf("Unexpected SMS form: %v\n", form)
+	}
+
+	// the gateway errors are returned
+	sender.Password = "wrong"
+	if err := sender.Send(message); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the gateway error, instead we've got %v\n", err)
+	}
+
+}
+
+// serveSMTP is a minimal in-process SMTP server which accepts a single email and returns its data
+func serveSMTP(t *testing.T, listener net.Listener, data chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		close(data)
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	var body []string
+	inData := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			close(data)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if inData {
+			if line == "." {
+				inData = false
+				reply("250 OK")
+				continue
+			}
+			body = append(body, line)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(line, "DATA"):
+			inData = true
+			reply("354 End data with <CR><LF>.<CR><LF>")
+		case strings.HasPrefix(line, "QUIT"):
+			reply("221 Bye")
+			data <- strings.Join(body, "\n")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	checkError(t, err)
+	defer listener.Close()
+
+	data := make(chan string, 1)
+	go serveSMTP(t, listener, data)
+
+	sender := &SMTPSender{Addr: listener.Addr().String(), From: "no-reply@sec51.com"}
+	message := OutOfBandMessage{Destination: "info@sec51.com", Issuer: "Sec51", Code: "123456", ExpiresAt: time.Unix(1234567890, 0)}
+	checkError(t, sender.Send(message))
+
+	email := <-data
+	if !strings.Contains(email, "To: info@sec51.com") || !strings.Contains(email, "Subject: Sec51 verification code") || !strings.Contains(email, "123456") {
+		t.Errorf("Unexpected email:\n%s\n", email)
+	}
+
+	// header injection is refused
+	message.Destination = "info@sec51.com\r\nBcc: evil@example.com"
+	if err := sender.Send(message); err == nil {
+		t.Error("Destination with a header injection has been accepted")
+	}
+
+}
+
+func TestOutOfBandWindow(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	o, err := NewOutOfBand("info@sec51.com", "Sec51", "+41000000000", WithClock(clock))
+	checkError(t, err)
+	sender := new(fakeSender)
+
+	// the code of the previous period is accepted, but the window stays on the current period:
+	// the codes are generated by the server clock, there is no drifting device to follow
+	checkError(t, o.Send(sender))
+	clock.Advance(delivery_step_size * time.Second)
+	checkError(t, o.Validate(sender.messages[0].Code))
+	checkError(t, o.Send(sender))
+	if err := o.Validate(sender.messages[1].Code); err != nil {
+		t.Fatal(err)
+	}
+	if o.otp.clientOffset != 0 {
+		t.Errorf("Client offset should be 0, instead we've got %d\n", o.otp.clientOffset)
+	}
+
+	// the deserialized delivery keeps the window on the current period
+	data, err := o.ToBytes()
+	checkError(t, err)
+	restored, err := OutOfBandFromBytes(data, "Sec51", WithClock(clock))
+	checkError(t, err)
+	if !restored.otp.fixedWindow {
+		t.Error("The deserialized delivery follows the drift of the client")
+	}
+
+}
@@ -0,0 +1,161 @@
+package twofactor
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+var (
+	envelopeIssuerError = errors.New("The issuer of the envelope does not match the one of the encrypted Totp")
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler
+// The data is an envelope of the encrypted bytes of ToBytes, prefixed by the issuer, which selects the encryption keys,
+// so that it can be decoded without passing the issuer separately:
+// Sizes:      4         N          N
+// Format: |issuer_size|issuer|encrypted_totp|
+func (otp *Totp) MarshalBinary() ([]byte, error) {
+
+	encrypted, err := otp.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	issuerSizeBytes := bigendian.ToInt(len(otp.issuer))
+	buffer.Write(issuerSizeBytes[:])
+	buffer.WriteString(otp.issuer)
+	buffer.Write(encrypted)
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, it decodes the envelope created by MarshalBinary
+// The keys are loaded from the keyring or the key store set via WithKeyring or WithKeyStore on the receiver,
+// otherwise from the one set via SetKeyStore.
+// The clock, the binding context and the generation tracker of the receiver, if set, are preserved,
+// as well as a custom lockout policy or code formatter, which are not persisted (see TOTPFromBytes).
+func (otp *Totp) UnmarshalBinary(data []byte) error {
+
+	if otp == nil {
+		return initializationFailedError
+	}
+
+	fr := newFieldReader(data)
+	issuer := string(fr.readSized("issuer"))
+	if fr.err != nil {
+		return fr.err
+	}
+	encrypted := data[4+len(issuer):]
+
+	var options []TotpOption
+	if otp.keyStore != nil {
+		options = append(options, WithKeyStore(otp.keyStore))
+	}
+	if otp.keyring != nil {
+		options = append(options, WithKeyring(otp.keyring))
+	}
+	if len(otp.bindingContext) > 0 {
+		options = append(options, WithBindingContext(otp.bindingContext))
+	}
+	if otp.generationTracker != nil {
+		options = append(options, WithGenerationTracker(otp.generationTracker))
+	}
+	if otp.clock != nil {
+		options = append(options, WithClock(otp.clock))
+	}
+	// the custom policy and formatter are not persisted, they are kept like the options of TOTPFromBytes
+	if otp.lockout != nil && otp.checkLockoutPolicy() == nil {
+		if policyType, _, _, _ := lockoutPolicyToValues(otp.lockout); policyType == lockout_custom {
+			options = append(options, WithLockoutPolicy(otp.lockout))
+		}
+	}
+	if otp.formatter != nil && otp.checkCodeFormatter() == nil {
+		if codeType, _ := codeFormatterToValues(otp.formatter); codeType == code_custom {
+			options = append(options, WithCodeFormatter(otp.formatter))
+		}
+	}
+
+	restored, err := TOTPFromBytes(encrypted, issuer, options...)
+	if err != nil {
+		return err
+	}
+
+	// the issuer selects the keys, but it's not authenticated
+	if restored.issuer != issuer {
+		return envelopeIssuerError
+	}
+
+	otp.restore(restored)
+	return nil
+}
+
+// Private function which replaces, under the lock, all the fields of the otp with the ones of the restored otp
+func (otp *Totp) restore(restored *Totp) {
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+	otp.key = restored.key
+	otp.counter = restored.counter
+	otp.digits = restored.digits
+	otp.formatter = restored.formatter
+	otp.issuer = restored.issuer
+	otp.account = restored.account
+	otp.stepSize = restored.stepSize
+	otp.clientOffset = restored.clientOffset
+	otp.totalVerificationFailures = restored.totalVerificationFailures
+	otp.lastVerificationTime = restored.lastVerificationTime
+	otp.lockouts = restored.lockouts
+	otp.lockout = restored.lockout
+	otp.hashFunction = restored.hashFunction
+	otp.clock = restored.clock
+	otp.lastAcceptedStep = restored.lastAcceptedStep
+	otp.windowPast = restored.windowPast
+	otp.windowFuture = restored.windowFuture
+	otp.keyStore = restored.keyStore
+	otp.keyring = restored.keyring
+	otp.bindingContext = restored.bindingContext
+	otp.generation = restored.generation
+	otp.generationTracker = restored.generationTracker
+}
+
+// MarshalJSON implements json.Marshaler, the envelope of MarshalBinary is encoded as a base64 string
+func (otp *Totp) MarshalJSON() ([]byte, error) {
+	data, err := otp.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, it decodes the base64 string created by MarshalJSON
+func (otp *Totp) UnmarshalJSON(data []byte) error {
+	var envelope []byte
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	return otp.UnmarshalBinary(envelope)
+}
+
+// Value implements driver.Valuer, the Totp is stored as the envelope of MarshalBinary, for instance in a bytea column
+func (otp *Totp) Value() (driver.Value, error) {
+	return otp.MarshalBinary()
+}
+
+// Scan implements sql.Scanner, it decodes the envelope stored by Value
+// A NULL value leaves the receiver untouched.
+func (otp *Totp) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return otp.UnmarshalBinary(data)
+	case string:
+		return otp.UnmarshalBinary([]byte(data))
+	default:
+		return fmt.Errorf("Cannot scan %T into a Totp", src)
+	}
+}
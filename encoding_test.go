@@ -0,0 +1,102 @@
+package twofactor
+
+import (
+	"crypto"
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// the interfaces implemented by Totp
+var (
+	_ encoding.BinaryMarshaler   = (*Totp)(nil)
+	_ encoding.BinaryUnmarshaler = (*Totp)(nil)
+	_ json.Marshaler             = (*Totp)(nil)
+	_ json.Unmarshaler           = (*Totp)(nil)
+	_ driver.Valuer              = (*Totp)(nil)
+	_ sql.Scanner                = (*Totp)(nil)
+)
+
+func TestEncodingInterfaces(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+	otp.Validate("00000000")
+
+	// binary
+	data, err := otp.MarshalBinary()
+	checkError(t, err)
+	restored := &Totp{clock: clock}
+	checkError(t, restored.UnmarshalBinary(data))
+	if restored.Secret() != otp.Secret() || restored.totalVerificationFailures != 1 || restored.clock != clock {
+		t.Errorf("Unexpected unmarshaled totp: %+v\n", restored)
+	}
+
+	// json
+	document := struct {
+		Account string `json:"account"`
+		OTP     *Totp  `json:"otp"`
+	}{"info@sec51.com", otp}
+	jsonData, err := json.Marshal(document)
+	checkError(t, err)
+	document.OTP = nil
+	checkError(t, json.Unmarshal(jsonData, &document))
+	if document.OTP == nil || document.OTP.Secret() != otp.Secret() {
+		t.Error("The totp has not been unmarshaled from JSON")
+	}
+
+	// database
+	value, err := otp.Value()
+	checkError(t, err)
+	scanned := new(Totp)
+	checkError(t, scanned.Scan(value))
+	if scanned.Secret() != otp.Secret() {
+		t.Error("The scanned secret differs from the original one")
+	}
+	if err := scanned.Scan(42); err == nil {
+		t.Error("An integer has been scanned into a totp")
+	}
+	null := new(Totp)
+	checkError(t, null.Scan(nil))
+	if null.key != nil {
+		t.Error("The NULL value has been scanned into a totp")
+	}
+
+	// the issuer of the envelope can not be changed
+	tampered := append([]byte{0, 0, 0, 5}, []byte("Other")...)
+	tampered = append(tampered, data[4+len("Sec51"):]...)
+	if err := new(Totp).UnmarshalBinary(tampered); err == nil {
+		t.Error("The envelope with a different issuer has been accepted")
+	}
+	if err := new(Totp).UnmarshalBinary(data[:3]); err == nil {
+		t.Error("The truncated envelope has been accepted")
+	}
+
+}
+
+func TestEncodingCustomSettings(t *testing.T) {
+
+	policy := &permanentLockoutWrapper{permanentLockout{maxFailures: 3}}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6, WithLockoutPolicy(policy), WithCodeFormatter(upperFormatter{}))
+	checkError(t, err)
+	data, err := otp.MarshalBinary()
+	checkError(t, err)
+
+	// the custom settings of the receiver are preserved
+	receiver, err := NewTOTP("other@sec51.com", "Sec51", crypto.SHA1, 6, WithLockoutPolicy(policy), WithCodeFormatter(upperFormatter{}))
+	checkError(t, err)
+	checkError(t, receiver.UnmarshalBinary(data))
+	if receiver.lockout != policy || receiver.formatter != (upperFormatter{}) || receiver.account != otp.account {
+		t.Errorf("Unexpected unmarshaled totp: %+v\n", receiver)
+	}
+
+	// without them the custom settings are missing
+	if err := new(Totp).UnmarshalBinary(data); err != LockoutPolicyMissingError && err != CodeFormatterMissingError {
+		t.Errorf("Expected the missing settings error, instead we've got %v\n", err)
+	}
+
+}
@@ -0,0 +1,197 @@
+package twofactor
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+const (
+	totp_format_version    = 1                                          // the current format version of the serialized Totp
+	max_serialized_backoff = uint64(math.MaxInt64 / int64(time.Second)) // upper bound of the serialized backoff seconds, so that they fit a time.Duration
+	max_serialized_counter = math.MaxInt32                              // upper bound of the serialized counters, the 4 bytes are read as an unsigned value on 64 bit platforms
+)
+
+var (
+	FormatVersionError = errors.New("The serialized data has an unsupported format version")
+	formatMarker       = []byte{0xFF, 0xFF, 0xFF, 0xFF} // marks the versioned formats, the unversioned one starts with the total size, which can't have this value
+)
+
+// the decoders of all the format versions of the serialized Totp
+// version 0: the unversioned format, with no header
+// version 1: the header followed by the fields described in Totp.ToBytes
+var totpDecoders = map[int]func([]byte) (*Totp, error){
+	0: deserializeTOTPv0,
+	1: deserializeTOTPv1,
+}
+
+// Private function which writes the header of the versioned formats
+func writeFormatHeader(buffer *bytes.Buffer, version int) {
+	versionBytes := bigendian.ToInt(version)
+	buffer.Write(formatMarker)
+	buffer.Write(versionBytes[:])
+}
+
+// Private function which reads the header of the versioned formats
+// It returns the format version and the data following the header.
+// The data without the header is of the unversioned format, version 0
+func readFormatHeader(data []byte) (int, []byte) {
+	if len(data) < 8 || !bytes.Equal(data[:4], formatMarker) {
+		return 0, data
+	}
+	return bigendian.FromInt([4]byte{data[4], data[5], data[6], data[7]}), data[8:]
+}
+
+// Private function which converts the clear text bytes of any format version to a totp object
+func deserializeTOTP(data []byte) (*Totp, error) {
+	version, body := readFormatHeader(data)
+	decoder, ok := totpDecoders[version]
+	if !ok {
+		return nil, FormatVersionError
+	}
+	return decoder(body)
+}
+
+// Private function which converts the clear text bytes of the unversioned format to a totp object
+// The unversioned format is the version 1 without the header, the code formatter and the generation,
+// where the last fields are optional: last_accepted_step, the validation window and the lockout policy were added later,
+// the data serialized without them is parsed with the step set to 0, the default window and the default policy.
+// The codes are decimal and the generation is 0.
+func deserializeTOTPv0(data []byte) (*Totp, error) {
+	return decodeTOTPFields(data, 0)
+}
+
+// Private function which converts the clear text bytes of the version 1, described in ToBytes, to a totp object
+func deserializeTOTPv1(data []byte) (*Totp, error) {
+	return decodeTOTPFields(data, 1)
+}
+
+// Private function which decodes the fields described in ToBytes
+// Every length and every value is validated, the corrupted data returns a DecodeError and never a partial Totp.
+// version: the format version, the unversioned format has optional trailing fields,
+// and neither the code formatter nor the generation
+func decodeTOTPFields(data []byte, version int) (*Totp, error) {
+
+	optionalTrailing := version == 0
+
+	fr := newFieldReader(data)
+	otp := new(Totp)
+	otp.clock = systemClock{}
+	otp.windowPast = window_size
+	otp.windowFuture = window_size
+	otp.lockout = defaultLockoutPolicy()
+
+	totalSize := fr.readInt("total_bytes")
+	fr.check("total_bytes", totalSize == len(data))
+	otp.key = fr.readSized("key")
+	fr.check("key", len(otp.key) > 0)
+	copy(otp.counter[:], fr.readBytes("counter", counter_size))
+	otp.digits = fr.readInt("digits")
+	if version < 1 {
+		fr.check("digits", otp.digits >= 6 && otp.digits <= 8)
+	} else {
+		fr.check("digits", otp.digits >= min_code_length && otp.digits <= max_code_length)
+	}
+	otp.issuer = string(fr.readSized("issuer"))
+	otp.account = string(fr.readSized("account"))
+	otp.stepSize = fr.readInt("steps")
+	fr.check("steps", otp.stepSize >= min_step_size && otp.stepSize <= max_step_size)
+	otp.clientOffset = int(int32(fr.readInt("offset"))) // the offset can be negative
+	fr.check("offset", otp.clientOffset >= -max_window_size && otp.clientOffset <= max_window_size)
+	otp.totalVerificationFailures = fr.readInt("total_failures")
+	fr.check("total_failures", otp.totalVerificationFailures >= 0 && otp.totalVerificationFailures <= max_serialized_counter)
+	verificationTime := fr.readUint64("verification_time")
+	hashType := fr.readInt("hashFunction_type")
+	fr.check("hashFunction_type", hashType >= 0 && hashType <= 2)
+	otp.hashFunction = hashFunctionFromType(hashType)
+
+	if !optionalTrailing || fr.remaining() > 0 {
+		otp.lastAcceptedStep = fr.readUint64("last_accepted_step")
+	}
+
+	if !optionalTrailing || fr.remaining() > 0 {
+		otp.windowPast = fr.readInt("window_past")
+		fr.check("window_past", otp.windowPast >= 0 && otp.windowPast <= max_window_size)
+		otp.windowFuture = fr.readInt("window_future")
+		fr.check("window_future", otp.windowFuture >= 0 && otp.windowFuture <= max_window_size)
+	}
+
+	if !optionalTrailing || fr.remaining() > 0 {
+		policyType := fr.readInt("lockout_type")
+		fr.check("lockout_type", policyType == lockout_flat || policyType == lockout_exponential || policyType == lockout_permanent || policyType == lockout_custom)
+		policyMaxFailures := fr.readInt("lockout_max_failures")
+		fr.check("lockout_max_failures", policyMaxFailures >= 0 && policyMaxFailures <= max_serialized_counter)
+		policyBackoff := fr.readUint64("lockout_backoff")
+		fr.check("lockout_backoff", policyBackoff <= max_serialized_backoff)
+		policyMaxBackoff := fr.readUint64("lockout_max_backoff")
+		fr.check("lockout_max_backoff", policyMaxBackoff <= max_serialized_backoff)
+		otp.lockouts = fr.readInt("lockouts")
+		fr.check("lockouts", otp.lockouts >= 0 && otp.lockouts <= max_serialized_counter)
+		otp.lockout = lockoutPolicyFromValues(policyType, policyMaxFailures, int64(policyBackoff), int64(policyMaxBackoff))
+	}
+
+	codeType, alphabet := code_decimal, ""
+	if version >= 1 {
+		codeType = fr.readInt("code_type")
+		fr.check("code_type", codeType == code_decimal || codeType == code_alphabet || codeType == code_custom)
+		alphabet = string(fr.readSized("alphabet"))
+		fr.check("alphabet", (codeType == code_alphabet) == (alphabet != "") && (alphabet == "" || validAlphabet(alphabet)))
+		fr.check("digits", codeType != code_decimal || (otp.digits >= 6 && otp.digits <= 8))
+	}
+	otp.formatter = codeFormatterFromValues(codeType, alphabet, otp.digits)
+
+	if version >= 1 {
+		otp.generation = fr.readUint64("generation")
+	}
+
+	if err := fr.close(); err != nil {
+		return nil, err
+	}
+
+	otp.lastVerificationTime = time.Unix(int64(verificationTime), 0)
+
+	return otp, nil
+}
+
+// MigrateTOTP upgrades the bytes serialized by ToBytes with an earlier format version to the current one.
+// It returns the bytes to be stored and whether they changed: the bytes already in the current format are returned as they are.
+// The options, for instance WithKeyStore, WithKeyring or WithBindingContext, are the ones of TOTPFromBytes.
+func MigrateTOTP(encryptedMessage []byte, issuer string, options ...TotpOption) ([]byte, bool, error) {
+
+	settings, err := settingsFromOptions(options)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// decrypt the message
+	data, err := decryptBytes(settings.currentKeyring(), issuer, encryptedMessage, message_type, settings.bindingContext)
+	if err != nil {
+		return nil, false, err
+	}
+
+	version, _ := readFormatHeader(data)
+	if version == totp_format_version {
+		return encryptedMessage, false, nil
+	}
+	otp, err := deserializeTOTP(data)
+	if err != nil {
+		return nil, false, err
+	}
+	otp.keyring = settings.currentKeyring()
+	otp.bindingContext = settings.bindingContext
+	otp.generationTracker = settings.generationTracker
+
+	// refuse the older states
+	if err := otp.observeGeneration(); err != nil {
+		return nil, false, err
+	}
+
+	migrated, err := otp.ToBytes()
+	if err != nil {
+		return nil, false, err
+	}
+	return migrated, true, nil
+}
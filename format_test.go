@@ -0,0 +1,110 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+// legacyTOTPBytes serializes the decimal codes otp in the unversioned format (version 0)
+// The unversioned format is truncated to the given amount of optional trailing fields:
+// 0 = none, 1 = last_accepted_step, 2 = validation window, 3 = lockout policy
+func legacyTOTPBytes(t *testing.T, otp *Totp, trailingFields int) []byte {
+	data, err := otp.serialize()
+	checkError(t, err)
+
+	// strip the header, the generation, the code formatter and the trailing fields
+	data = data[8 : len(data)-16]
+	sizes := []int{28, 8, 8}
+	for i := 0; i < 3-trailingFields; i++ {
+		data = data[:len(data)-sizes[i]]
+	}
+	totalSize := bigendian.ToInt(len(data))
+	copy(data, totalSize[:])
+
+	encrypted, err := encryptBytes(otp.currentKeyring(), otp.issuer, string(data), message_type, nil)
+	checkError(t, err)
+	return encrypted
+}
+
+func TestFormatVersions(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 7, WithClock(clock), WithWindow(2, 0),
+		WithLockoutPolicy(NewExponentialLockout(5, time.Minute, time.Hour)))
+	checkError(t, err)
+	otp.totalVerificationFailures = 2
+	otp.lastVerificationTime = clock.Now()
+	otp.lastAcceptedStep = 41152263
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	plain, err := decryptBytes(NewKeyring(nil), "Sec51", data, message_type, nil)
+	checkError(t, err)
+	if version, _ := readFormatHeader(plain); version != totp_format_version {
+		t.Fatalf("Expected the format version %d, instead we've got %d\n", totp_format_version, version)
+	}
+
+	// the current format is not migrated
+	migrated, changed, err := MigrateTOTP(data, "Sec51")
+	checkError(t, err)
+	if changed || !bytes.Equal(migrated, data) {
+		t.Error("The current format has been migrated")
+	}
+
+	// all the unversioned formats are parsed and migrated
+	for fields := 0; fields <= 3; fields++ {
+		legacy := legacyTOTPBytes(t, otp, fields)
+
+		restored, err := TOTPFromBytes(legacy, "Sec51")
+		checkError(t, err)
+		if restored.Secret() != otp.Secret() || restored.digits != 7 || restored.hashFunction != crypto.SHA256 || restored.totalVerificationFailures != 2 || restored.generation != 0 {
+			t.Errorf("Unversioned format with %d trailing fields: unexpected otp %+v\n", fields, restored)
+		}
+
+		migrated, changed, err := MigrateTOTP(legacy, "Sec51")
+		checkError(t, err)
+		if !changed {
+			t.Errorf("Unversioned format with %d trailing fields has not been migrated\n", fields)
+		}
+		plain, err := decryptBytes(NewKeyring(nil), "Sec51", migrated, message_type, nil)
+		checkError(t, err)
+		if version, _ := readFormatHeader(plain); version != totp_format_version {
+			t.Errorf("Expected the migrated format version %d, instead we've got %d\n", totp_format_version, version)
+		}
+
+		restored, err = TOTPFromBytes(migrated, "Sec51")
+		checkError(t, err)
+		wantStep, wantWindow, wantPolicy := uint64(0), window_size, defaultLockoutPolicy()
+		if fields >= 1 {
+			wantStep = otp.lastAcceptedStep
+		}
+		if fields >= 2 {
+			wantWindow = 2
+		}
+		if fields >= 3 {
+			wantPolicy = otp.lockout
+		}
+		if restored.lastAcceptedStep != wantStep || restored.windowPast != wantWindow || !reflect.DeepEqual(restored.lockout, wantPolicy) {
+			t.Errorf("Unversioned format with %d trailing fields: unexpected migrated otp %+v\n", fields, restored)
+		}
+	}
+
+	// unknown versions are refused
+	var buffer bytes.Buffer
+	writeFormatHeader(&buffer, totp_format_version+1)
+	buffer.Write(plain[8:])
+	unknown, err := encryptBytes(NewKeyring(nil), "Sec51", buffer.String(), message_type, nil)
+	checkError(t, err)
+	if _, err := TOTPFromBytes(unknown, "Sec51"); err != FormatVersionError {
+		t.Errorf("Expected the format version error, instead we've got %v\n", err)
+	}
+	if _, _, err := MigrateTOTP(unknown, "Sec51"); err != FormatVersionError {
+		t.Errorf("Expected the format version error while migrating, instead we've got %v\n", err)
+	}
+
+}
@@ -0,0 +1,19 @@
+//go:build go1.18
+// +build go1.18
+
+package twofactor
+
+import (
+	"testing"
+)
+
+// The fuzzing needs Go 1.18, the decoding of the corrupted data is checked by TestDecodeCounters as well
+func FuzzDeserializeTOTP(f *testing.F) {
+	data := validTOTPData(f)
+	f.Add(data)
+	f.Add(data[8:])
+	f.Add(data[:len(data)/2])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecoded(t, data)
+	})
+}
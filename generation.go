@@ -0,0 +1,124 @@
+package twofactor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+const (
+	generation_file_suffix = ".generation" // the extension of the files of the FileGenerationTracker
+)
+
+var (
+	RollbackError          = errors.New("The stored state is older than the last one seen, it may have been restored from an old copy")
+	generationTrackerError = errors.New("The generation tracker cannot be nil")
+)
+
+// GenerationTracker keeps the high-water mark of the generations of the persisted Totp states, keyed by the issuer:account label.
+// Each ToBytes increments the generation stored inside the encrypted bytes, therefore restoring an older copy of the bytes,
+// which would reset the verification failures and the lockout, is detected by comparing its generation with the mark.
+// The tracker must not be stored together with the encrypted bytes, otherwise both can be restored at once.
+// Implementations must be safe for concurrent use.
+type GenerationTracker interface {
+	// Observe returns RollbackError if the generation is older than the mark of the account, otherwise it raises the mark
+	Observe(account string, generation uint64) error
+}
+
+// Generation returns the generation of the state, the number of times it has been serialized by ToBytes
+// The states serialized by the previous versions of the package have the generation 0.
+func (otp *Totp) Generation() uint64 {
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+	return otp.generation
+}
+
+// Private function which checks the generation of the otp with its tracker, if any
+func (otp *Totp) observeGeneration() error {
+	if otp.generationTracker == nil {
+		return nil
+	}
+	return otp.generationTracker.Observe(otp.label(), otp.Generation())
+}
+
+// MemoryGenerationTracker is a GenerationTracker which keeps the marks in memory, they are lost when the process exits
+type MemoryGenerationTracker struct {
+	mutex       sync.Mutex
+	generations map[string]uint64
+}
+
+// NewMemoryGenerationTracker creates an empty MemoryGenerationTracker
+func NewMemoryGenerationTracker() *MemoryGenerationTracker {
+	return &MemoryGenerationTracker{generations: make(map[string]uint64)}
+}
+
+// Observe returns RollbackError if the generation is older than the mark of the account, otherwise it raises the mark
+func (t *MemoryGenerationTracker) Observe(account string, generation uint64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if generation < t.generations[account] {
+		return RollbackError
+	}
+	t.generations[account] = generation
+	return nil
+}
+
+// FileGenerationTracker is a GenerationTracker which keeps the mark of each account in a file, inside a folder.
+// The file name is the SHA256 of the account, the file content is the generation:
+// Sizes:       8
+// Format: |generation|
+// The files are replaced atomically, by renaming a temporary file.
+// The marks are checked under a lock of the process: the folder must not be shared by several processes.
+type FileGenerationTracker struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileGenerationTracker creates a FileGenerationTracker in the folder path, the folder is created with 0700 permissions if it does not exist
+func NewFileGenerationTracker(path string) (*FileGenerationTracker, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &FileGenerationTracker{path: path}, nil
+}
+
+// returns the file of the account
+func (t *FileGenerationTracker) file(account string) string {
+	hash := sha256.Sum256([]byte(account))
+	return filepath.Join(t.path, hex.EncodeToString(hash[:])+generation_file_suffix)
+}
+
+// Observe returns RollbackError if the generation is older than the mark of the account, otherwise it raises the mark
+func (t *FileGenerationTracker) Observe(account string, generation uint64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var current uint64
+	content, err := ioutil.ReadFile(t.file(account))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		fr := newFieldReader(content)
+		current = fr.readUint64("generation")
+		if err := fr.close(); err != nil {
+			return err
+		}
+	}
+
+	if generation < current {
+		return RollbackError
+	}
+	if generation == current && content != nil {
+		return nil
+	}
+
+	generationBytes := bigendian.ToUint64(generation)
+	return writeFileAtomically(t.path, t.file(account), generationBytes[:])
+}
@@ -0,0 +1,142 @@
+package twofactor
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testGenerationTracker(t *testing.T, tracker GenerationTracker) {
+
+	checkError(t, tracker.Observe("Sec51:info@sec51.com", 0))
+	checkError(t, tracker.Observe("Sec51:info@sec51.com", 2))
+
+	// the same generation can be loaded again, the older ones are refused
+	checkError(t, tracker.Observe("Sec51:info@sec51.com", 2))
+	if err := tracker.Observe("Sec51:info@sec51.com", 1); err != RollbackError {
+		t.Errorf("Expected the rollback error, instead we've got %v\n", err)
+	}
+
+	// the accounts are independent
+	checkError(t, tracker.Observe("Sec51:other@sec51.com", 1))
+
+}
+
+func TestMemoryGenerationTracker(t *testing.T) {
+	testGenerationTracker(t, NewMemoryGenerationTracker())
+}
+
+func TestFileGenerationTracker(t *testing.T) {
+	path, err := ioutil.TempDir("", "twofactor")
+	checkError(t, err)
+	defer os.RemoveAll(path)
+
+	tracker, err := NewFileGenerationTracker(path)
+	checkError(t, err)
+	testGenerationTracker(t, tracker)
+
+	// the marks survive the restart of the process
+	tracker, err = NewFileGenerationTracker(path)
+	checkError(t, err)
+	if err := tracker.Observe("Sec51:info@sec51.com", 1); err != RollbackError {
+		t.Errorf("Expected the rollback error after the restart, instead we've got %v\n", err)
+	}
+}
+
+func TestRollbackProtection(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	// each serialization is a new generation
+	old, err := otp.ToBytes()
+	checkError(t, err)
+	current, err := otp.ToBytes()
+	checkError(t, err)
+	if otp.Generation() != 2 {
+		t.Fatalf("Expected the generation 2, instead we've got %d\n", otp.Generation())
+	}
+
+	tracker := NewMemoryGenerationTracker()
+	restored, err := TOTPFromBytes(current, "Sec51", WithGenerationTracker(tracker))
+	checkError(t, err)
+	if restored.Generation() != 2 {
+		t.Errorf("Expected the deserialized generation 2, instead we've got %d\n", restored.Generation())
+	}
+	if _, err := TOTPFromBytes(old, "Sec51", WithGenerationTracker(tracker)); err != RollbackError {
+		t.Errorf("Expected the rollback error, instead we've got %v\n", err)
+	}
+	if _, err := TOTPFromBytes(old, "Sec51"); err != nil {
+		t.Errorf("The old bytes have been refused without a tracker: %v\n", err)
+	}
+	// the tracker of the otp records each serialization right away
+	tracked, err := NewTOTP("tracked@sec51.com", "Sec51", crypto.SHA1, 8, WithGenerationTracker(tracker))
+	checkError(t, err)
+	older, err := tracked.ToBytesWith(tracked.currentKeyring())
+	checkError(t, err)
+	_, err = tracked.ToBytesWithContext(NewBindingContext("users", "1"))
+	checkError(t, err)
+	newer, err := tracked.ToBytes()
+	checkError(t, err)
+	if _, err := TOTPFromBytes(older, "Sec51", WithGenerationTracker(tracker)); err != RollbackError {
+		t.Errorf("Expected the rollback error of the older serialization, instead we've got %v\n", err)
+	}
+	_, err = TOTPFromBytes(newer, "Sec51", WithGenerationTracker(tracker))
+	checkError(t, err)
+
+	// and so does the out of band delivery, apart from the otp of the same account
+	delivery, err := NewOutOfBand("tracked@sec51.com", "Sec51", "+41000000000", WithGenerationTracker(tracker))
+	checkError(t, err)
+	olderDelivery, err := delivery.ToBytes()
+	checkError(t, err)
+	newerDelivery, err := delivery.ToBytes()
+	checkError(t, err)
+	if _, err := OutOfBandFromBytes(olderDelivery, "Sec51", WithGenerationTracker(tracker)); err != RollbackError {
+		t.Errorf("Expected the rollback error of the older delivery, instead we've got %v\n", err)
+	}
+	_, err = OutOfBandFromBytes(newerDelivery, "Sec51", WithGenerationTracker(tracker))
+	checkError(t, err)
+
+	if _, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithGenerationTracker(nil)); err != generationTrackerError {
+		t.Errorf("Expected the generation tracker error, instead we've got %v\n", err)
+	}
+
+}
+
+func TestTotpStoreRollback(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	memory := NewMemoryStore()
+	store := NewTotpStore(memory, "Sec51", WithClock(clock), WithGenerationTracker(NewMemoryGenerationTracker()))
+	checkError(t, store.Create("info@sec51.com", otp))
+
+	// copy the bytes before the failures
+	snapshot, _, err := memory.Load("info@sec51.com")
+	checkError(t, err)
+
+	if err := store.ValidateAndStore("info@sec51.com", "00000000"); err == nil {
+		t.Fatal("The wrong token has been accepted")
+	}
+	stored, version, err := store.Load("info@sec51.com")
+	checkError(t, err)
+	if stored.totalVerificationFailures != 1 {
+		t.Fatalf("Expected 1 failure, instead we've got %d\n", stored.totalVerificationFailures)
+	}
+
+	// the old bytes, without the failure, are refused
+	_, err = memory.Save("info@sec51.com", snapshot, version)
+	checkError(t, err)
+	if _, _, err := store.Load("info@sec51.com"); err != RollbackError {
+		t.Errorf("Expected the rollback error, instead we've got %v\n", err)
+	}
+	if err := store.ValidateAndStore("info@sec51.com", "00000000"); err != RollbackError {
+		t.Errorf("Expected the rollback error while validating, instead we've got %v\n", err)
+	}
+
+}
@@ -0,0 +1,345 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+	qr "github.com/sec51/qrcode"
+)
+
+const (
+	hotp_look_ahead     = 10  // default amount of counter values checked ahead of the server counter (see RFC 4226 section 7.4)
+	hotp_message_type   = 1   // this is the message type for the crypto engine when serializing a HOTP
+	hotp_max_look_ahead = 100 // upper bound of the look ahead window, a too big window makes brute forcing easier
+)
+
+// WARNING: The `Hotp` struct should never be instantiated manually!
+// Use the `NewHOTP` function
+type Hotp struct {
+	key                       []byte      // this is the secret key
+	counter                   uint64      // this is the moving counter, it's the next counter value expected from the client device
+	digits                    int         // total amount of digits of the code displayed on the device
+	issuer                    string      // the company which issues the 2FA
+	account                   string      // usually the user email or the account id
+	lookAhead                 int         // the amount of counter values checked ahead of the moving counter
+	totalVerificationFailures int         // the total amount of verification failures from the client
+	lastVerificationTime      time.Time   // the last verification executed
+	hashFunction              crypto.Hash // the hash function used in the HMAC construction (sha1 - sha156 - sha512)
+}
+
+// This function creates a new HOTP object (RFC 4226)
+// This is the counter based counterpart of the TOTP and it is used for instance with event based hardware tokens
+// account: usually the user email
+// issuer: the name of the company/service
+// hash: is the crypto function used: crypto.SHA1, crypto.SHA256, crypto.SHA512
+// digits: is the token amount of digits (6 or 7 or 8)
+// lookAhead: the amount of counter values, ahead of the stored one, that are accepted during the validation (by default 10)
+// it automatically generates a secret key using the golang crypto rand package. If there is not enough entropy the function returns an error
+// The key is not encrypted in this package. It's a secret key. Therefore if you transfer the key bytes in the network,
+// please take care of protecting the key or in fact all the bytes.
+func NewHOTP(account, issuer string, hash crypto.Hash, digits, lookAhead int) (*Hotp, error) {
+
+	keySize := hash.Size()
+	key := make([]byte, keySize)
+	total, err := rand.Read(key)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("HOTP failed to create because there is not enough entropy, we got only %d random bytes", total))
+	}
+
+	// sanitize the digits range otherwise it may create invalid tokens !
+	if digits < 6 || digits > 8 {
+		digits = 8
+	}
+
+	// sanitize the look ahead window
+	if lookAhead < 0 || lookAhead > hotp_max_look_ahead {
+		lookAhead = hotp_look_ahead
+	}
+
+	return makeHOTP(key, account, issuer, hash, digits, lookAhead)
+
+}
+
+// Private function which initialize the HOTP so that it's easier to unit test it
+// Used internally
+func makeHOTP(key []byte, account, issuer string, hash crypto.Hash, digits, lookAhead int) (*Hotp, error) {
+	otp := new(Hotp)
+	otp.key = key
+	otp.account = account
+	otp.issuer = issuer
+	otp.digits = digits
+	otp.counter = 0
+	otp.lookAhead = lookAhead
+	otp.hashFunction = hash
+	return otp, nil
+}
+
+// Counter returns the current value of the moving counter
+// This is the next counter value the server expects from the client device
+func (otp *Hotp) Counter() uint64 {
+	return otp.counter
+}
+
+// Label returns the combination of issuer:account string
+func (otp *Hotp) label() string {
+	return formatLabel(otp.issuer, otp.account)
+}
+
+// Generates the one time password for the current value of the moving counter with hmac-(HASH-FUNCTION)
+// This is the next token the server expects from the client device. The counter is not changed:
+// only a successful validation moves it forward.
+func (otp *Hotp) OTP() (string, error) {
+	return otp.OTPAt(otp.counter)
+}
+
+// OTPAt generates the one time password of the counter value, without changing the moving counter
+func (otp *Hotp) OTPAt(counter uint64) (string, error) {
+
+	// verify the proper initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return "", err
+	}
+
+	return calculateHOTP(otp, counter), nil
+}
+
+// Private function which calculates the HOTP token for the given counter value
+func calculateHOTP(otp *Hotp, counter uint64) string {
+	h := newHMAC(otp.hashFunction, otp.key)
+	counterBytes := bigendian.ToUint64(counter)
+	return calculateToken(counterBytes[:], decimalFormatter(otp.digits), h)
+}
+
+// This function validates the user provided token
+// It calculates the tokens from the current moving counter up to the look ahead window.
+// If one of them matches, the moving counter is re-synchronized to the value following the matched one,
+// so that the same token can never be accepted twice.
+// It also updates the total amount of verification failures and the last time a verification happened in UTC time
+// Returns an error in case of verification failure, with the reason: ErrEmptyToken, ErrMismatch or LockDownError
+// The same back-off as the TOTP applies: after 3 failures the function returns an error for the following 5 minutes
+func (otp *Hotp) Validate(userCode string) error {
+
+	// check Hotp initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+
+	// verify that the token is valid
+	if userCode == "" {
+		return ErrEmptyToken
+	}
+
+	now := time.Now()
+	policy := defaultLockoutPolicy()
+	state := LockoutState{Failures: otp.totalVerificationFailures, LastFailure: otp.lastVerificationTime}
+
+	// check against the default lockout policy
+	if isLockedOut(policy, state, now) {
+		return LockDownError
+	}
+
+	// all the tokens of the look ahead window are compared in constant time, like the Totp ones
+	userToken := []byte(userCode)
+	found, match := 0, 0
+	for i := 0; i <= otp.lookAhead; i++ {
+		equal := subtle.ConstantTimeCompare([]byte(calculateHOTP(otp, otp.counter+uint64(i))), userToken)
+		match = subtle.ConstantTimeSelect(equal&^found, i, match)
+		found |= equal
+	}
+
+	if found == 1 {
+		// re-synchronize the moving counter and forget the failures
+		otp.counter += uint64(match) + 1
+		otp.totalVerificationFailures = 0
+		return nil
+	}
+
+	state = policy.Fail(state, now.UTC()) // important to have it in UTC
+	otp.totalVerificationFailures = state.Failures
+	otp.lastVerificationTime = state.LastFailure
+
+	return ErrMismatch
+}
+
+// Secret returns the underlying base32 encoded secret.
+// This should only be displayed the first time a user enables 2FA,
+// and should be transmitted over a secure connection.
+// Useful for supporting HOTP clients that don't support QR scanning.
+func (otp *Hotp) Secret() string {
+	return base32.StdEncoding.EncodeToString(otp.key)
+}
+
+// URL returns a suitable URL, such as for the Google Authenticator app
+// example: otpauth://hotp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example&algorithm=SHA1&digits=6&counter=0
+func (otp *Hotp) url() (string, error) {
+
+	// verify the proper initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return "", err
+	}
+
+	// label, escaped like the one of the Totp, see URLBuilder
+	label := escapeLabelPart(otp.account)
+	if otp.issuer != "" {
+		label = escapeLabelPart(otp.issuer) + ":" + label
+	}
+
+	// the parameters are written in the order of the Key URI format documentation
+	parameters := []string{"secret=" + strings.TrimRight(otp.Secret(), "=")}
+	if otp.issuer != "" {
+		parameters = append(parameters, "issuer="+escapeParameter(otp.issuer))
+	}
+	parameters = append(parameters,
+		"algorithm="+algorithmName(otp.hashFunction),
+		"digits="+strconv.Itoa(otp.digits),
+		"counter="+strconv.FormatUint(otp.counter, 10),
+	)
+
+	return "otpauth://hotp/" + label + "?" + strings.Join(parameters, "&"), nil
+}
+
+// QR generates a byte array containing QR code encoded PNG image, with level Q error correction,
+// needed for the client apps to generate tokens
+// The QR code should be displayed only the first time the user enabled the Two-Factor authentication.
+// The QR code contains the shared KEY between the server application and the client application,
+// therefore the QR code should be delivered via secure connection.
+func (otp *Hotp) QR() ([]byte, error) {
+
+	// get the URL
+	u, err := otp.url()
+
+	// check for errors during initialization
+	// this is already done on the URL method
+	if err != nil {
+		return nil, err
+	}
+	code, err := qr.Encode(u, qr.Q)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(), nil
+}
+
+// ToBytes serialises a HOTP object in a byte array
+// Sizes:         4        4      N     8       4        4        N         4          N        4            4               8                 4
+// Format: |total_bytes|key_size|key|counter|digits|issuer_size|issuer|account_size|account|look_ahead|total_failures|verification_time|hashFunction_type|
+// hashFunction_type: 0 = SHA1; 1 = SHA256; 2 = SHA512
+// The data is encrypted using the cryptoengine library (which is a wrapper around the golang NaCl library)
+func (otp *Hotp) ToBytes() ([]byte, error) {
+
+	// check Hotp initialization
+	if err := hotpHasBeenInitialized(otp); err != nil {
+		return nil, err
+	}
+
+	data, err := otp.serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypt the HOTP bytes
+	return encryptBytes(sharedKeyring(), otp.issuer, string(data), hotp_message_type, nil)
+}
+
+// Private function which serializes the HOTP object in clear text, in the format described in ToBytes
+func (otp *Hotp) serialize() ([]byte, error) {
+
+	var buffer bytes.Buffer
+
+	keySize := len(otp.key)
+	issuerSize := len(otp.issuer)
+	accountSize := len(otp.account)
+
+	totalSize := 4 + 4 + keySize + 8 + 4 + 4 + issuerSize + 4 + accountSize + 4 + 4 + 8 + 4
+	totalSizeBytes := bigendian.ToInt(totalSize)
+	keySizeBytes := bigendian.ToInt(keySize)
+	counterBytes := bigendian.ToUint64(otp.counter)
+	digitBytes := bigendian.ToInt(otp.digits)
+	issuerSizeBytes := bigendian.ToInt(issuerSize)
+	accountSizeBytes := bigendian.ToInt(accountSize)
+	lookAheadBytes := bigendian.ToInt(otp.lookAhead)
+	totalFailuresBytes := bigendian.ToInt(otp.totalVerificationFailures)
+	verificationTimeBytes := bigendian.ToUint64(uint64(otp.lastVerificationTime.Unix()))
+	hashTypeBytes := bigendian.ToInt(hashFunctionType(otp.hashFunction))
+
+	// at this point we are ready to write the data to the byte buffer
+	fields := [][]byte{
+		totalSizeBytes[:],
+		keySizeBytes[:],
+		otp.key,
+		counterBytes[:],
+		digitBytes[:],
+		issuerSizeBytes[:],
+		[]byte(otp.issuer),
+		accountSizeBytes[:],
+		[]byte(otp.account),
+		lookAheadBytes[:],
+		totalFailuresBytes[:],
+		verificationTimeBytes[:],
+		hashTypeBytes[:],
+	}
+	for _, field := range fields {
+		if _, err := buffer.Write(field); err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// HOTPFromBytes converts a byte array to a hotp object
+// it stores the state of the HOTP object, like the key, the moving counter, the look ahead window,
+// the total amount of verification failures and the last time a verification happened
+func HOTPFromBytes(encryptedMessage []byte, issuer string) (*Hotp, error) {
+
+	// decrypt the message
+	data, err := decryptBytes(sharedKeyring(), issuer, encryptedMessage, hotp_message_type, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fr := newFieldReader(data)
+	otp := new(Hotp)
+
+	totalSize := fr.readInt("total_bytes")
+	fr.check("total_bytes", totalSize == len(data))
+	otp.key = fr.readSized("key")
+	fr.check("key", len(otp.key) > 0)
+	otp.counter = fr.readUint64("counter")
+	otp.digits = fr.readInt("digits")
+	fr.check("digits", otp.digits >= 6 && otp.digits <= 8)
+	otp.issuer = string(fr.readSized("issuer"))
+	otp.account = string(fr.readSized("account"))
+	otp.lookAhead = fr.readInt("look_ahead")
+	fr.check("look_ahead", otp.lookAhead >= 0 && otp.lookAhead <= hotp_max_look_ahead)
+	otp.totalVerificationFailures = fr.readInt("total_failures")
+	fr.check("total_failures", otp.totalVerificationFailures >= 0 && otp.totalVerificationFailures <= max_serialized_counter)
+	verificationTime := fr.readUint64("verification_time")
+	hashType := fr.readInt("hashFunction_type")
+	fr.check("hashFunction_type", hashType >= 0 && hashType <= 2)
+	otp.hashFunction = hashFunctionFromType(hashType)
+
+	if err := fr.close(); err != nil {
+		return nil, err
+	}
+	otp.lastVerificationTime = time.Unix(int64(verificationTime), 0)
+
+	return otp, nil
+}
+
+// this method checks the proper initialization of the Hotp object
+func hotpHasBeenInitialized(otp *Hotp) error {
+	if otp == nil || otp.key == nil || len(otp.key) == 0 {
+		return initializationFailedError
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package twofactor
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 4226 - Appendix D test values
+var hotpTestData = []string{
+	"755224",
+	"287082",
+	"359152",
+	"969429",
+	"338314",
+	"254676",
+	"287922",
+	"162583",
+	"399871",
+	"520489",
+}
+
+func TestHOTP(t *testing.T) {
+
+	key, err := hex.DecodeString(sha1KeyHex)
+	checkError(t, err)
+
+	otp, err := makeHOTP(key, "no-reply@sec51.com", "Sec51", crypto.SHA1, 6, hotp_look_ahead)
+	checkError(t, err)
+
+	for index, expected := range hotpTestData {
+		token, err := otp.OTPAt(uint64(index))
+		checkError(t, err)
+		if token != expected {
+			t.Errorf("HOTP test data, token mismatch. Got %s, expected %s\n", token, expected)
+		}
+	}
+
+	// the token of the moving counter is generated without changing the counter, only the validation moves it
+	for i := 0; i < 2; i++ {
+		token, err := otp.OTP()
+		checkError(t, err)
+		if token != hotpTestData[0] || otp.Counter() != 0 {
+			t.Errorf("Expected the token %s of the counter 0, instead we've got %s of the counter %d\n", hotpTestData[0], token, otp.Counter())
+		}
+	}
+	token, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, otp.Validate(token))
+	if token, _ := otp.OTP(); token != hotpTestData[1] {
+		t.Errorf("Expected the token %s after the validation, instead we've got %s\n", hotpTestData[1], token)
+	}
+
+}
+
+func TestHOTPValidation(t *testing.T) {
+
+	key, err := hex.DecodeString(sha1KeyHex)
+	checkError(t, err)
+
+	otp, err := makeHOTP(key, "no-reply@sec51.com", "Sec51", crypto.SHA1, 6, 3)
+	checkError(t, err)
+
+	// the first token is valid and moves the counter forward
+	if err := otp.Validate(hotpTestData[0]); err != nil {
+		t.Fatal(err)
+	}
+	if otp.Counter() != 1 {
+		t.Errorf("Expected the counter to be 1, instead we've got %d\n", otp.Counter())
+	}
+
+	// the same token can not be used twice
+	if err := otp.Validate(hotpTestData[0]); err == nil {
+		t.Error("HOTP token accepted twice")
+	}
+
+	// a token inside the look ahead window re-synchronizes the counter
+	if err := otp.Validate(hotpTestData[4]); err != nil {
+		t.Fatal(err)
+	}
+	if otp.Counter() != 5 {
+		t.Errorf("Expected the counter to be 5, instead we've got %d\n", otp.Counter())
+	}
+
+	// a token outside of the look ahead window is rejected
+	if err := otp.Validate(hotpTestData[9]); err != ErrMismatch {
+		t.Errorf("Expected the mismatch error, instead we've got %v\n", err)
+	}
+	if err := otp.Validate(""); err != ErrEmptyToken {
+		t.Errorf("Expected the empty token error, instead we've got %v\n", err)
+	}
+
+	// after 3 failures in a row the validation is locked down
+	otp.Validate("000000")
+	otp.Validate("000000")
+	if err := otp.Validate(hotpTestData[5]); err != LockDownError {
+		t.Errorf("Expected the lock down error, instead we've got %v\n", err)
+	}
+
+	// once the back off time elapsed the validation works again
+	otp.lastVerificationTime = time.Now().UTC().Add(-10 * time.Minute)
+	if err := otp.Validate(hotpTestData[5]); err != nil {
+		t.Fatal(err)
+	}
+	if otp.totalVerificationFailures != 0 {
+		t.Errorf("totalVerificationFailures counter not reset to zero. We've got: %d\n", otp.totalVerificationFailures)
+	}
+
+}
+
+func TestHOTPSerialization(t *testing.T) {
+
+	otp, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA256, 7, 5)
+	checkError(t, err)
+
+	otp.counter = 42
+	otp.totalVerificationFailures = 2
+	otp.lastVerificationTime = time.Now().UTC()
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+
+	restored, err := HOTPFromBytes(data, otp.issuer)
+	checkError(t, err)
+
+	if restored.Secret() != otp.Secret() {
+		t.Error("Deserialized key differ from original HOTP")
+	}
+	if restored.counter != otp.counter {
+		t.Error("Deserialized counter differ from original HOTP")
+	}
+	if restored.digits != otp.digits {
+		t.Error("Deserialized digits differ from original HOTP")
+	}
+	if restored.lookAhead != otp.lookAhead {
+		t.Error("Deserialized lookAhead differ from original HOTP")
+	}
+	if restored.totalVerificationFailures != otp.totalVerificationFailures {
+		t.Error("Deserialized totalVerificationFailures differ from original HOTP")
+	}
+	if restored.lastVerificationTime.Unix() != otp.lastVerificationTime.Unix() {
+		t.Error("Deserialized lastVerificationTime differ from original HOTP")
+	}
+	if restored.hashFunction != otp.hashFunction {
+		t.Error("Deserialized hash differ from original HOTP")
+	}
+	if restored.label() != otp.label() {
+		t.Error("Deserialized label differ from original HOTP")
+	}
+
+	// a HOTP blob can not be parsed as a TOTP
+	if _, err := TOTPFromBytes(data, otp.issuer); err == nil {
+		t.Error("HOTP bytes were parsed as TOTP")
+	}
+
+	// the out of range values are refused: a huge look ahead would compute billions of HMACs per validation
+	corrupted := []struct {
+		field   string
+		corrupt func(*Hotp)
+	}{
+		{"look_ahead", func(otp *Hotp) { otp.lookAhead = 1<<31 - 1 }},
+		{"look_ahead", func(otp *Hotp) { otp.lookAhead = -1 }},
+		{"total_failures", func(otp *Hotp) { otp.totalVerificationFailures = -1 }},
+	}
+	for _, test := range corrupted {
+		copied := *otp
+		test.corrupt(&copied)
+		data, err := copied.ToBytes()
+		checkError(t, err)
+		var decodeErr *DecodeError
+		if _, err := HOTPFromBytes(data, otp.issuer); !errors.As(err, &decodeErr) || decodeErr.Field != test.field {
+			t.Errorf("Expected the decode error on the field %s, instead we've got %v\n", test.field, err)
+		}
+	}
+
+}
+
+func TestHOTPURL(t *testing.T) {
+
+	otp, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA1, 6, hotp_look_ahead)
+	checkError(t, err)
+	otp.counter = 7
+
+	u, err := otp.url()
+	checkError(t, err)
+
+	if !strings.HasPrefix(u, "otpauth://hotp/Sec51:info@sec51.com?") {
+		t.Errorf("Unexpected HOTP URL: %s\n", u)
+	}
+	if !strings.Contains(u, "counter=7") {
+		t.Errorf("HOTP URL does not contain the counter: %s\n", u)
+	}
+
+	if _, err := otp.QR(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the label is escaped like the one of the Totp
+	otp.issuer, otp.account = "Acme: Inc", "alice smith"
+	u, err = otp.url()
+	checkError(t, err)
+	if !strings.HasPrefix(u, "otpauth://hotp/Acme%3A%20Inc:alice%20smith?") || !strings.Contains(u, "issuer=Acme%3A%20Inc&") {
+		t.Errorf("Unexpected escaping of the HOTP URL: %s\n", u)
+	}
+
+	if _, err := (&Hotp{}).url(); err == nil {
+		t.Fatal("Hotp is not properly initialized and the method did not catch it")
+	}
+
+}
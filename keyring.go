@@ -0,0 +1,113 @@
+package twofactor
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/sec51/cryptoengine"
+)
+
+var (
+	keyringError = errors.New("The keyring cannot be nil")
+)
+
+// Keyring holds the crypto engines of the issuers, so that the keys are loaded from the key store only once
+// The package key store, set via SetKeyStore, has a shared keyring. With a key store set via WithKeyStore and without a keyring,
+// each ToBytes and FromBytes call loads all the keys of the issuer from the key store, which for the file key store means reading 5 files.
+// A Keyring is safe for concurrent use. Create it once and pass it via WithKeyring, or use ToBytesWith and TOTPFromBytesWith.
+// The engines see the key rotations done via the keyring. After a rotation done elsewhere, for instance by another process,
+// the bytes encrypted with the new key are still decrypted, because the engine is reloaded once when a key is missing,
+// but the old key is used for the encryption until Reload is called.
+type Keyring struct {
+	store   cryptoengine.KeyStore                 // the store of the encryption keys
+	engines map[string]*cryptoengine.CryptoEngine // the engines already loaded, by sanitized issuer, see cryptoengine.SanitizeIdentifier
+	mutex   sync.Mutex                            // guards the engines
+}
+
+// NewKeyring creates a keyring which loads the keys from the store
+// A nil store means the key store set via SetKeyStore at the time the keyring is created, or the cryptoengine default.
+func NewKeyring(store cryptoengine.KeyStore) *Keyring {
+	if store == nil {
+		store = currentKeyStore()
+	}
+	return &Keyring{store: store, engines: make(map[string]*cryptoengine.CryptoEngine)}
+}
+
+// Private function which returns the engine of the issuer, loading it the first time
+// The engine is loaded under the lock, so that the missing keys of a new issuer are generated only once.
+// The issuers which share the same keys, like "Acme Inc" and "acme_inc", share the same engine as well.
+func (k *Keyring) engine(issuer string) (*cryptoengine.CryptoEngine, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	id := cryptoengine.SanitizeIdentifier(issuer)
+	if engine, ok := k.engines[id]; ok {
+		return engine, nil
+	}
+	engine, err := cryptoengine.InitCryptoEngineWithKeyStore(issuer, k.store)
+	if err != nil {
+		return nil, err
+	}
+	k.engines[id] = engine
+	return engine, nil
+}
+
+// Reload drops the engine of the issuer, the keys are loaded again from the key store at the next use
+// It's needed after a key rotation which did not go through the keyring.
+func (k *Keyring) Reload(issuer string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.engines, cryptoengine.SanitizeIdentifier(issuer))
+}
+
+// RotateKey generates a new encryption key for the issuer, see the package RotateKey
+// The engine of the keyring uses the new key right away.
+func (k *Keyring) RotateKey(issuer string) (uint32, error) {
+	engine, err := k.engine(issuer)
+	if err != nil {
+		return 0, err
+	}
+	return engine.RotateKey()
+}
+
+// RetireKey deletes an old encryption key of the issuer, see the package RetireKey
+// The engine of the keyring stops decrypting with the key right away.
+func (k *Keyring) RetireKey(issuer string, keyID uint32) error {
+	engine, err := k.engine(issuer)
+	if err != nil {
+		return err
+	}
+	return engine.RetireKey(keyID)
+}
+
+// Private function which returns the keyring of the otp
+// Without the WithKeyring option, it's a new keyring of the key store set via WithKeyStore, which is used only once,
+// otherwise the keyring of the package key store, which is shared.
+func (otp *Totp) currentKeyring() *Keyring {
+	if otp.keyring != nil {
+		return otp.keyring
+	}
+	if otp.keyStore != nil {
+		return NewKeyring(otp.keyStore)
+	}
+	return sharedKeyring()
+}
+
+// Private function which returns the keyring set by the options, or the keyring of the key store set by the options
+func keyringFromOptions(options []TotpOption) (*Keyring, error) {
+	settings, err := settingsFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return settings.currentKeyring(), nil
+}
+
+// Private function which applies the options to a scratch Totp
+// The encryption settings, like the keyring and the binding context, are needed before the Totp is deserialized
+func settingsFromOptions(options []TotpOption) (*Totp, error) {
+	scratch := new(Totp)
+	if err := applyTotpOptions(scratch, options); err != nil {
+		return nil, err
+	}
+	return scratch, nil
+}
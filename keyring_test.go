@@ -0,0 +1,234 @@
+package twofactor
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sec51/cryptoengine"
+)
+
+// countingKeyStore counts the keys loaded from the underlying store
+type countingKeyStore struct {
+	cryptoengine.KeyStore
+	loads int64
+}
+
+func (s *countingKeyStore) Load(name string) ([]byte, error) {
+	atomic.AddInt64(&s.loads, 1)
+	return s.KeyStore.Load(name)
+}
+
+func TestKeyring(t *testing.T) {
+
+	store := &countingKeyStore{KeyStore: cryptoengine.NewMemoryKeyStore()}
+	keyring := NewKeyring(store)
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithKeyStore(store))
+	checkError(t, err)
+
+	data, err := otp.ToBytesWith(keyring)
+	checkError(t, err)
+	loads := atomic.LoadInt64(&store.loads)
+
+	// the keys are loaded only once, also by concurrent calls
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := otp.ToBytesWith(keyring); err != nil {
+					t.Error(err)
+				}
+				if _, err := TOTPFromBytesWith(data, "Sec51", keyring); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt64(&store.loads) != loads {
+		t.Errorf("The keys have been loaded again: %d loads instead of %d\n", atomic.LoadInt64(&store.loads), loads)
+	}
+
+	// the keyring is set on the deserialized totp and it's the same as the key store
+	restored, err := TOTPFromBytesWith(data, "Sec51", keyring)
+	checkError(t, err)
+	if restored.keyring != keyring || restored.Secret() != otp.Secret() {
+		t.Error("The keyring has not been set on the deserialized totp")
+	}
+	restored, err = TOTPFromBytes(data, "Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if restored.Secret() != otp.Secret() {
+		t.Error("Deserialized secret differs from the original one")
+	}
+
+	// the rotation done via the keyring is used right away
+	keyID, err := RotateKey("Sec51", WithKeyring(keyring))
+	checkError(t, err)
+	current, err := otp.ToBytesWith(keyring)
+	checkError(t, err)
+	if id, _ := cryptoengine.MessageKeyID(current); id != keyID {
+		t.Errorf("Expected the key id %d, instead we've got %d\n", keyID, id)
+	}
+
+	// the rotation done elsewhere is picked up when a key is missing
+	keyID, err = RotateKey("Sec51", WithKeyStore(store))
+	checkError(t, err)
+	current, err = otp.ToBytes()
+	checkError(t, err)
+	if id, _ := cryptoengine.MessageKeyID(current); id != keyID {
+		t.Fatalf("Expected the key id %d, instead we've got %d\n", keyID, id)
+	}
+	_, err = TOTPFromBytesWith(current, "Sec51", keyring)
+	checkError(t, err)
+
+	if _, err := otp.ToBytesWith(nil); err != keyringError {
+		t.Errorf("Expected the keyring error, instead we've got %v\n", err)
+	}
+	if _, err := TOTPFromBytesWith(data, "Sec51", nil); err != keyringError {
+		t.Errorf("Expected the keyring error, instead we've got %v\n", err)
+	}
+
+}
+
+func TestKeyringSanitizedIssuer(t *testing.T) {
+
+	keyring := NewKeyring(cryptoengine.NewMemoryKeyStore())
+	otp, err := NewTOTP("info@sec51.com", "acme_inc", crypto.SHA1, 8)
+	checkError(t, err)
+
+	// the issuers which share the same keys share the same engine
+	first, err := keyring.engine("Acme Inc")
+	checkError(t, err)
+	second, err := keyring.engine("acme_inc")
+	checkError(t, err)
+	if first != second {
+		t.Fatal("The issuers of the same keys have different engines")
+	}
+
+	// the rotation is seen by both
+	keyID, err := keyring.RotateKey("Acme Inc")
+	checkError(t, err)
+	data, err := otp.ToBytesWith(keyring)
+	checkError(t, err)
+	if id, _ := cryptoengine.MessageKeyID(data); id != keyID {
+		t.Errorf("Expected the key id %d, instead we've got %d\n", keyID, id)
+	}
+
+	keyring.Reload(" ACME INC ")
+	if len(keyring.engines) != 0 {
+		t.Error("The engine has not been reloaded")
+	}
+
+}
+
+func TestSharedKeyring(t *testing.T) {
+
+	store := &countingKeyStore{KeyStore: cryptoengine.NewMemoryKeyStore()}
+	SetKeyStore(store)
+	defer SetKeyStore(nil)
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	hotp, err := NewHOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, hotp_look_ahead)
+	checkError(t, err)
+	rc, _, err := NewRecoveryCodes("info@sec51.com", "Sec51", 1)
+	checkError(t, err)
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	loads := atomic.LoadInt64(&store.loads)
+
+	// the Totp, the Hotp and the recovery codes share the keys of the package key store
+	for i := 0; i < 3; i++ {
+		_, err := TOTPFromBytes(data, "Sec51")
+		checkError(t, err)
+		hotpData, err := hotp.ToBytes()
+		checkError(t, err)
+		_, err = HOTPFromBytes(hotpData, "Sec51")
+		checkError(t, err)
+		rcData, err := rc.ToBytes()
+		checkError(t, err)
+		_, err = RecoveryCodesFromBytes(rcData, "Sec51")
+		checkError(t, err)
+	}
+	if atomic.LoadInt64(&store.loads) != loads {
+		t.Errorf("The keys have been loaded again: %d loads instead of %d\n", atomic.LoadInt64(&store.loads), loads)
+	}
+
+	// the rotation and the retirement go through the shared keyring
+	_, err = RotateKey("Sec51")
+	checkError(t, err)
+	checkError(t, RetireKey("Sec51", 0))
+	if _, err := TOTPFromBytes(data, "Sec51"); err == nil {
+		t.Error("The bytes encrypted with a retired key have been decrypted")
+	}
+
+	// a new key store drops the loaded keys
+	SetKeyStore(cryptoengine.NewMemoryKeyStore())
+	if _, err := TOTPFromBytes(data, "Sec51"); err == nil {
+		t.Error("The bytes have been decrypted with the keys of the previous key store")
+	}
+
+}
+
+func benchmarkSerialization(b *testing.B, keyring *Keyring, options ...TotpOption) {
+	otp, err := NewTOTP("info@sec51.com", "Sec51 Benchmark", crypto.SHA1, 8, options...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data, err := otp.ToBytes()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("ToBytes", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if keyring != nil {
+				_, err = otp.ToBytesWith(keyring)
+			} else {
+				_, err = otp.ToBytes()
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("FromBytes", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if keyring != nil {
+				_, err = TOTPFromBytesWith(data, "Sec51 Benchmark", keyring, options...)
+			} else {
+				_, err = TOTPFromBytes(data, "Sec51 Benchmark", options...)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// The keys are files, like with the default key store: without a keyring each call reads them again
+func BenchmarkSerialization(b *testing.B) {
+	path, err := ioutil.TempDir("", "twofactor")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	store := cryptoengine.NewFileKeyStore(path)
+	b.Run("KeyStore", func(b *testing.B) {
+		benchmarkSerialization(b, nil, WithKeyStore(store))
+	})
+	b.Run("Keyring", func(b *testing.B) {
+		benchmarkSerialization(b, NewKeyring(store), WithKeyStore(store))
+	})
+	b.Run("SetKeyStore", func(b *testing.B) {
+		SetKeyStore(store)
+		defer SetKeyStore(nil)
+		benchmarkSerialization(b, nil)
+	})
+}
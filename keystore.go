@@ -0,0 +1,66 @@
+package twofactor
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/sec51/cryptoengine"
+)
+
+var (
+	keyStoreError = errors.New("The key store cannot be nil")
+
+	keyStoreMutex   sync.RWMutex
+	defaultKeyStore cryptoengine.KeyStore // the key store used when none is set on the Totp, nil means the cryptoengine default
+	defaultKeyring  *Keyring              // the keyring of the package key store, created at the first use
+)
+
+// SetKeyStore sets the key store of the encryption keys used by all the ToBytes and FromBytes functions,
+// unless the Totp has its own key store, set via WithKeyStore.
+// By default the keys are files in the folder defined by the SEC51_KEYPATH environment variable (cryptoengine.DefaultKeyStore).
+// Passing nil restores the default. The keys already loaded from the previous key store are dropped.
+func SetKeyStore(store cryptoengine.KeyStore) {
+	keyStoreMutex.Lock()
+	defer keyStoreMutex.Unlock()
+	defaultKeyStore = store
+	defaultKeyring = nil
+}
+
+// Private function which returns the key store set via SetKeyStore, or the cryptoengine default
+func currentKeyStore() cryptoengine.KeyStore {
+	keyStoreMutex.RLock()
+	defer keyStoreMutex.RUnlock()
+	if defaultKeyStore == nil {
+		return cryptoengine.DefaultKeyStore()
+	}
+	return defaultKeyStore
+}
+
+// Private function which returns the keyring of the package key store, shared by all the calls without their own keyring or key store
+// It's created at the first use, so the default key store reads the SEC51_KEYPATH environment variable only once.
+func sharedKeyring() *Keyring {
+	keyStoreMutex.Lock()
+	defer keyStoreMutex.Unlock()
+	if defaultKeyring == nil {
+		store := defaultKeyStore
+		if store == nil {
+			store = cryptoengine.DefaultKeyStore()
+		}
+		defaultKeyring = NewKeyring(store)
+	}
+	return defaultKeyring
+}
+
+// ReloadKeys drops the keys of the issuer loaded from the package key store, they are loaded again at the next use
+// It's needed after a key rotation done by another process, like Keyring.Reload.
+func ReloadKeys(issuer string) {
+	sharedKeyring().Reload(issuer)
+}
+
+// Private function which returns the key store of the otp, or the package one
+func (otp *Totp) currentKeyStore() cryptoengine.KeyStore {
+	if otp.keyStore != nil {
+		return otp.keyStore
+	}
+	return currentKeyStore()
+}
@@ -0,0 +1,61 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/sec51/cryptoengine"
+)
+
+func TestKeyStore(t *testing.T) {
+
+	store := cryptoengine.NewMemoryKeyStore()
+	otp, err := NewTOTP("info@sec51.com", "Sec51 KeyStore", crypto.SHA1, 8, WithKeyStore(store))
+	checkError(t, err)
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+
+	// all the keys have been created in the store
+	for _, name := range cryptoengine.KeyNames("Sec51 KeyStore") {
+		if _, err := store.Load(name); err != nil {
+			t.Errorf("The key %s has not been stored: %v\n", name, err)
+		}
+	}
+
+	restored, err := TOTPFromBytes(data, "Sec51 KeyStore", WithKeyStore(store))
+	checkError(t, err)
+	if restored.Secret() != otp.Secret() {
+		t.Error("Deserialized secret differs from the original one")
+	}
+
+	// the keys of a different store can not decrypt the data
+	if _, err := TOTPFromBytes(data, "Sec51 KeyStore", WithKeyStore(cryptoengine.NewMemoryKeyStore())); err == nil {
+		t.Error("The data has been decrypted with the keys of a different store")
+	}
+
+	// a read only store with the provisioned keys
+	keys := make(map[string][]byte)
+	for _, name := range cryptoengine.KeyNames("Sec51 KeyStore") {
+		keys[name], _ = store.Load(name)
+	}
+	SetKeyStore(cryptoengine.NewStaticKeyStore(keys))
+	defer SetKeyStore(nil)
+
+	restored, err = TOTPFromBytes(data, "Sec51 KeyStore")
+	checkError(t, err)
+	if restored.Secret() != otp.Secret() {
+		t.Error("Deserialized secret differs from the original one")
+	}
+
+	// the read only store does not generate the missing keys
+	if _, err := otp.ToBytes(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTOTP("info@sec51.com", "Other", crypto.SHA1, 8)
+	checkError(t, err)
+	if _, err := other.ToBytes(); err != cryptoengine.KeyStoreReadOnlyError {
+		t.Errorf("Expected the read only error, instead we've got %v\n", err)
+	}
+
+}
@@ -0,0 +1,214 @@
+package twofactor
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	lockout_flat        = 0   // serialized type of the flat lockout policy
+	lockout_exponential = 1   // serialized type of the exponential backoff lockout policy
+	lockout_permanent   = 2   // serialized type of the permanent lockout policy
+	lockout_custom      = 255 // serialized type of a policy not implemented in this package
+)
+
+var (
+	lockoutPolicyError        = errors.New("The lockout policy cannot be nil")
+	LockoutPolicyMissingError = errors.New("The lockout policy is custom, it needs to be passed via the WithLockoutPolicy option")
+
+	// the time returned by the permanent lockout policy once the verification is locked
+	lockedForever = time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// LockoutState is the state the lockout policies work on.
+// It is stored in the Totp and persisted together with it.
+type LockoutState struct {
+	Failures    int       // the amount of failures since the last successful verification or since the last lock expired
+	Lockouts    int       // the amount of locks triggered since the last successful verification
+	LastFailure time.Time // the time of the last failure, in UTC
+}
+
+// LockoutPolicy decides when the verification is locked because of too many failures.
+// The Totp calls Fail for each failed verification and LockedUntil before each verification.
+// After a successful verification the state is reset to its zero value.
+type LockoutPolicy interface {
+	// LockedUntil returns the time until which the verification is locked.
+	// The verification is allowed again only after that time. The zero time means it's not locked.
+	LockedUntil(state LockoutState) time.Time
+
+	// Fail returns the new state after a verification failure happened at the time t.
+	// It's never called while the verification is locked.
+	Fail(state LockoutState, t time.Time) LockoutState
+}
+
+// NewFlatLockout creates a policy which locks the verification for the backoff duration
+// after maxFailures failures. Once the backoff expired the failures start again from zero.
+// This is the default policy: 3 failures and 5 minutes backoff.
+func NewFlatLockout(maxFailures int, backoff time.Duration) LockoutPolicy {
+	return &flatLockout{maxFailures: sanitizeMaxFailures(maxFailures), backoff: backoff}
+}
+
+// NewExponentialLockout creates a policy which locks the verification after maxFailures failures.
+// The first lock lasts backoff, every following lock doubles the duration, up to maxBackoff.
+// The duration goes back to backoff only after a successful verification.
+func NewExponentialLockout(maxFailures int, backoff, maxBackoff time.Duration) LockoutPolicy {
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return &exponentialLockout{maxFailures: sanitizeMaxFailures(maxFailures), backoff: backoff, maxBackoff: maxBackoff}
+}
+
+// NewPermanentLockout creates a policy which locks the verification forever after maxFailures failures.
+// The lock can be removed only via ResetLockout, for instance from an administration tool.
+func NewPermanentLockout(maxFailures int) LockoutPolicy {
+	return &permanentLockout{maxFailures: sanitizeMaxFailures(maxFailures)}
+}
+
+// the default policy, it behaves like the lockout of the previous versions of the package
+func defaultLockoutPolicy() LockoutPolicy {
+	return NewFlatLockout(max_failures, backoff_minutes*time.Minute)
+}
+
+// at least one failure is needed to trigger a lock
+func sanitizeMaxFailures(maxFailures int) int {
+	if maxFailures < 1 {
+		return max_failures
+	}
+	return maxFailures
+}
+
+type flatLockout struct {
+	maxFailures int
+	backoff     time.Duration
+}
+
+func (p *flatLockout) LockedUntil(state LockoutState) time.Time {
+	if state.Failures < p.maxFailures {
+		return time.Time{}
+	}
+	return state.LastFailure.Add(p.backoff)
+}
+
+func (p *flatLockout) Fail(state LockoutState, t time.Time) LockoutState {
+	// the previous lock expired
+	if state.Failures >= p.maxFailures {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailure = t.UTC()
+	return state
+}
+
+type exponentialLockout struct {
+	maxFailures int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+func (p *exponentialLockout) LockedUntil(state LockoutState) time.Time {
+	if state.Failures < p.maxFailures {
+		return time.Time{}
+	}
+	backoff := p.backoff
+	// a zero backoff never grows and doubling past maxBackoff could overflow:
+	// the loop stops as soon as the duration can't change anymore
+	for i := 0; i < state.Lockouts && backoff > 0 && backoff < p.maxBackoff; i++ {
+		if backoff > p.maxBackoff/2 {
+			backoff = p.maxBackoff
+		} else {
+			backoff *= 2
+		}
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	return state.LastFailure.Add(backoff)
+}
+
+func (p *exponentialLockout) Fail(state LockoutState, t time.Time) LockoutState {
+	// the previous lock expired, the next one lasts twice as much
+	if state.Failures >= p.maxFailures {
+		state.Failures = 0
+		state.Lockouts++
+	}
+	state.Failures++
+	state.LastFailure = t.UTC()
+	return state
+}
+
+type permanentLockout struct {
+	maxFailures int
+}
+
+func (p *permanentLockout) LockedUntil(state LockoutState) time.Time {
+	if state.Failures < p.maxFailures {
+		return time.Time{}
+	}
+	return lockedForever
+}
+
+func (p *permanentLockout) Fail(state LockoutState, t time.Time) LockoutState {
+	state.Failures++
+	state.LastFailure = t.UTC()
+	return state
+}
+
+// Returns true if the policy locks the verification at the time t
+func isLockedOut(policy LockoutPolicy, state LockoutState, t time.Time) bool {
+	until := policy.LockedUntil(state)
+	return !until.IsZero() && !t.After(until)
+}
+
+// Returns the serialized representation of the policy: type, max failures, backoff and max backoff in seconds
+// Policies not implemented in this package can not be serialized and are stored as lockout_custom
+func lockoutPolicyToValues(policy LockoutPolicy) (int, int, int64, int64) {
+	switch p := policy.(type) {
+	case *flatLockout:
+		return lockout_flat, p.maxFailures, int64(p.backoff / time.Second), 0
+	case *exponentialLockout:
+		return lockout_exponential, p.maxFailures, int64(p.backoff / time.Second), int64(p.maxBackoff / time.Second)
+	case *permanentLockout:
+		return lockout_permanent, p.maxFailures, 0, 0
+	default:
+		return lockout_custom, 0, 0, 0
+	}
+}
+
+// Returns the policy from its serialized representation
+// A custom policy can not be restored, a missingLockout is returned instead:
+// the custom policy needs to be passed again via the WithLockoutPolicy option (see checkLockoutPolicy)
+func lockoutPolicyFromValues(policyType, maxFailures int, backoff, maxBackoff int64) LockoutPolicy {
+	switch policyType {
+	case lockout_flat:
+		return NewFlatLockout(maxFailures, time.Duration(backoff)*time.Second)
+	case lockout_exponential:
+		return NewExponentialLockout(maxFailures, time.Duration(backoff)*time.Second, time.Duration(maxBackoff)*time.Second)
+	case lockout_permanent:
+		return NewPermanentLockout(maxFailures)
+	case lockout_custom:
+		return missingLockout{}
+	default:
+		return defaultLockoutPolicy()
+	}
+}
+
+// missingLockout stands for a custom policy which has not been passed again after the deserialization.
+// The Totp serializes it back to lockout_custom, but it never leaves the package:
+// the deserialized Totp is refused unless the policy is replaced, still it locks the verification in the meantime.
+type missingLockout struct{}
+
+func (p missingLockout) LockedUntil(state LockoutState) time.Time {
+	return lockedForever
+}
+
+func (p missingLockout) Fail(state LockoutState, t time.Time) LockoutState {
+	return state
+}
+
+// Private function which checks that the custom lockout policy of the deserialized Totp has been passed again
+func (otp *Totp) checkLockoutPolicy() error {
+	if _, ok := otp.lockout.(missingLockout); ok {
+		return LockoutPolicyMissingError
+	}
+	return nil
+}
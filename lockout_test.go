@@ -0,0 +1,165 @@
+package twofactor
+
+import (
+	"crypto"
+	"testing"
+	"time"
+)
+
+// fails the verification n times with a wrong token
+func failValidation(otp *Totp, n int) {
+	for i := 0; i < n; i++ {
+		otp.Validate("00000000")
+	}
+}
+
+func TestFlatLockout(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithLockoutPolicy(NewFlatLockout(2, time.Minute)))
+	checkError(t, err)
+
+	failValidation(otp, 2)
+	expected := clock.Now().Add(time.Minute)
+	if !otp.LockedUntil().Equal(expected) {
+		t.Errorf("Expected the lock until %s, instead we've got %s\n", expected, otp.LockedUntil())
+	}
+
+	// once expired the user gets again 2 attempts, with the same backoff
+	clock.Advance(time.Minute + time.Second)
+	if !otp.LockedUntil().IsZero() {
+		t.Fatal("The lock did not expire")
+	}
+	failValidation(otp, 2)
+	expected = clock.Now().Add(time.Minute)
+	if !otp.LockedUntil().Equal(expected) {
+		t.Errorf("Expected the lock until %s, instead we've got %s\n", expected, otp.LockedUntil())
+	}
+
+}
+
+func TestExponentialLockout(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	policy := NewExponentialLockout(3, time.Minute, 3*time.Minute)
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithLockoutPolicy(policy))
+	checkError(t, err)
+
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		failValidation(otp, 3)
+		expected := clock.Now().Add(backoff)
+		if !otp.LockedUntil().Equal(expected) {
+			t.Errorf("Expected the lock until %s, instead we've got %s\n", expected, otp.LockedUntil())
+		}
+
+		// the attempts while locked do not extend the lock
+		failValidation(otp, 1)
+		if !otp.LockedUntil().Equal(expected) {
+			t.Errorf("The lock has been extended to %s\n", otp.LockedUntil())
+		}
+		clock.Advance(backoff + time.Second)
+	}
+
+	// the lock state survives the serialization
+	failValidation(otp, 3)
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, otp.issuer, WithClock(clock))
+	checkError(t, err)
+	if !restored.LockedUntil().Equal(otp.LockedUntil()) {
+		t.Errorf("Deserialized lock differ from original TOTP: %s %s\n", restored.LockedUntil(), otp.LockedUntil())
+	}
+	if restored.lockouts != otp.lockouts {
+		t.Errorf("Deserialized lockouts differ from original TOTP: %d %d\n", restored.lockouts, otp.lockouts)
+	}
+
+	// a successful verification resets the backoff
+	clock.Advance(3*time.Minute + time.Second)
+	token, err := restored.OTP()
+	checkError(t, err)
+	checkError(t, restored.Validate(token))
+	failValidation(restored, 3)
+	expected := clock.Now().Add(time.Minute)
+	if !restored.LockedUntil().Equal(expected) {
+		t.Errorf("Expected the lock until %s, instead we've got %s\n", expected, restored.LockedUntil())
+	}
+
+	// a zero backoff never grows, the amount of lockouts doesn't matter
+	state := LockoutState{Failures: 1, Lockouts: 1<<31 - 1, LastFailure: clock.Now()}
+	if until := NewExponentialLockout(1, 0, time.Hour).LockedUntil(state); !until.Equal(clock.Now()) {
+		t.Errorf("Expected the lock until %s, instead we've got %s\n", clock.Now(), until)
+	}
+
+}
+
+func TestPermanentLockout(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithLockoutPolicy(NewPermanentLockout(5)))
+	checkError(t, err)
+
+	failValidation(otp, 5)
+	clock.Advance(24 * 365 * time.Hour)
+	token, err := otp.OTP()
+	checkError(t, err)
+	if err := otp.Validate(token); err != LockDownError {
+		t.Fatalf("Expected the lock down error, instead we've got %v\n", err)
+	}
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, otp.issuer, WithClock(clock))
+	checkError(t, err)
+	if restored.LockedUntil().IsZero() {
+		t.Fatal("The permanent lock did not survive the serialization")
+	}
+
+	// the admin path removes the lock
+	restored.ResetLockout()
+	if !restored.LockedUntil().IsZero() {
+		t.Fatal("The lock has not been reset")
+	}
+	if err := restored.Validate(token); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestCustomLockoutPolicy(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithLockoutPolicy(&permanentLockoutWrapper{permanentLockout{maxFailures: 3}}))
+	checkError(t, err)
+
+	data, err := otp.ToBytes()
+	checkError(t, err)
+
+	// a custom policy is not persisted, it needs to be passed again
+	if _, err := TOTPFromBytes(data, otp.issuer); err != LockoutPolicyMissingError {
+		t.Fatalf("Expected LockoutPolicyMissingError, instead we've got %v\n", err)
+	}
+	restored, err := TOTPFromBytes(data, otp.issuer, WithLockoutPolicy(otp.lockout))
+	checkError(t, err)
+	if restored.lockout != otp.lockout {
+		t.Errorf("Expected the custom policy, instead we've got %T\n", restored.lockout)
+	}
+
+	// the migration keeps the policy custom
+	migrated, changed, err := MigrateTOTP(legacyTOTPBytes(t, otp, 3), otp.issuer)
+	checkError(t, err)
+	if !changed {
+		t.Fatal("The legacy bytes have not been migrated")
+	}
+	if _, err := TOTPFromBytes(migrated, otp.issuer); err != LockoutPolicyMissingError {
+		t.Errorf("Expected LockoutPolicyMissingError, instead we've got %v\n", err)
+	}
+
+	if _, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithLockoutPolicy(nil)); err == nil {
+		t.Error("A nil lockout policy has been accepted")
+	}
+
+}
+
+// a policy implemented outside of the package
+type permanentLockoutWrapper struct {
+	permanentLockout
+}
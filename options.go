@@ -0,0 +1,145 @@
+package twofactor
+
+import (
+	"github.com/sec51/cryptoengine"
+)
+
+// TotpOption configures a Totp at construction time
+// Options are applied in order, after the default values have been set
+type TotpOption func(otp *Totp) error
+
+// WithClock sets the clock used by the Totp for all the time dependent operations
+func WithClock(clock Clock) TotpOption {
+	return func(otp *Totp) error {
+		if clock == nil {
+			return clockError
+		}
+		otp.clock = clock
+		return nil
+	}
+}
+
+// WithWindow sets the validation window: the amount of steps in the past and in the future
+// accepted, besides the current one, while validating a token.
+// The window is centred on the step of the device: the current step plus the drift followed by the last successful
+// verification, see Validate. WithWindow(0, 0) accepts only the token of the step of the device,
+// which is the current step until a drifting device has been validated with a wider window.
+// Both sizes must be between 0 and 10
+func WithWindow(past, future int) TotpOption {
+	return func(otp *Totp) error {
+		if past < 0 || past > max_window_size || future < 0 || future > max_window_size {
+			return windowSizeError
+		}
+		otp.windowPast = past
+		otp.windowFuture = future
+		return nil
+	}
+}
+
+// WithPeriod sets the period, the amount of seconds a token is valid
+// The period drives the time step counter, the validation window and the period parameter of the otpauth URL.
+// It must be between 5 and 600 seconds. Most of the authenticator apps support only the default 30 seconds period.
+func WithPeriod(seconds int) TotpOption {
+	return func(otp *Totp) error {
+		if seconds < min_step_size || seconds > max_step_size {
+			return stepSizeError
+		}
+		otp.stepSize = seconds
+		return nil
+	}
+}
+
+// WithLockoutPolicy sets the policy which locks the verification after too many failures
+// The built-in policies are persisted by ToBytes. A custom implementation of LockoutPolicy is not,
+// therefore it needs to be passed again to TOTPFromBytes, otherwise LockoutPolicyMissingError is returned.
+func WithLockoutPolicy(policy LockoutPolicy) TotpOption {
+	return func(otp *Totp) error {
+		if policy == nil {
+			return lockoutPolicyError
+		}
+		otp.lockout = policy
+		return nil
+	}
+}
+
+// WithCodeFormatter sets the formatter of the codes, for instance NewSteamGuardFormatter, instead of the decimal ones
+// The digits of the Totp become the length of the codes of the formatter.
+// The formatters of this package are persisted by ToBytes. A custom implementation of CodeFormatter is not,
+// therefore it needs to be passed again to TOTPFromBytes, otherwise CodeFormatterMissingError is returned.
+func WithCodeFormatter(formatter CodeFormatter) TotpOption {
+	return func(otp *Totp) error {
+		if formatter == nil {
+			return codeFormatterError
+		}
+		if formatter.Length() < min_code_length || formatter.Length() > max_code_length {
+			return CodeLengthError
+		}
+		otp.formatter = formatter
+		otp.digits = formatter.Length()
+		return nil
+	}
+}
+
+// WithKeyStore sets the key store of the encryption keys used by ToBytes and TOTPFromBytes,
+// instead of the one set via SetKeyStore. The key store is not persisted by ToBytes,
+// therefore it needs to be passed again to TOTPFromBytes.
+func WithKeyStore(store cryptoengine.KeyStore) TotpOption {
+	return func(otp *Totp) error {
+		if store == nil {
+			return keyStoreError
+		}
+		otp.keyStore = store
+		return nil
+	}
+}
+
+// WithKeyring sets the keyring which holds the crypto engines used by ToBytes and TOTPFromBytes,
+// so that the keys are not loaded from the key store at each call. The keyring takes precedence over the key store.
+// The keyring is not persisted by ToBytes, therefore it needs to be passed again to TOTPFromBytes.
+func WithKeyring(keyring *Keyring) TotpOption {
+	return func(otp *Totp) error {
+		if keyring == nil {
+			return keyringError
+		}
+		otp.keyring = keyring
+		return nil
+	}
+}
+
+// WithBindingContext binds the encrypted bytes of ToBytes to the context, for instance NewBindingContext("users", accountID),
+// see ToBytesWithContext. The same context is needed by TOTPFromBytes, MigrateTOTP and ReencryptTOTP, otherwise the decryption fails.
+// The context is not persisted by ToBytes, therefore it needs to be passed again to TOTPFromBytes.
+func WithBindingContext(context []byte) TotpOption {
+	return func(otp *Totp) error {
+		if len(context) == 0 {
+			return bindingContextError
+		}
+		otp.bindingContext = context
+		return nil
+	}
+}
+
+// WithGenerationTracker sets the tracker which refuses to load the states older than the last one seen,
+// see GenerationTracker. TOTPFromBytes, MigrateTOTP and OutOfBandFromBytes return RollbackError for the older states.
+// ToBytes, ToBytesWith and ToBytesWithContext record the new generation right away: the bytes need to be stored,
+// otherwise the ones stored before are refused. The TotpStore created with this option records the generation
+// of each state once it has been saved. The tracker is not persisted by ToBytes, therefore it needs to be passed again to TOTPFromBytes.
+func WithGenerationTracker(tracker GenerationTracker) TotpOption {
+	return func(otp *Totp) error {
+		if tracker == nil {
+			return generationTrackerError
+		}
+		otp.generationTracker = tracker
+		return nil
+	}
+}
+
+// Private function which applies the options to the Totp
+func applyTotpOptions(otp *Totp, options []TotpOption) error {
+	for _, option := range options {
+		if err := option(otp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package twofactor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+var (
+	TruncatedDataError = errors.New("The serialized data is truncated")
+	InvalidLengthError = errors.New("The serialized data has an invalid length")
+	InvalidValueError  = errors.New("The serialized data has an invalid value")
+	TrailingDataError  = errors.New("The serialized data has unexpected trailing bytes")
+)
+
+// DecodeError is returned when the serialized data is corrupted
+// Field is the name of the field which could not be decoded,
+// Err is the kind of corruption: TruncatedDataError, InvalidLengthError, InvalidValueError or TrailingDataError
+type DecodeError struct {
+	Field string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Err, e.Field)
+}
+
+// Unwrap returns the kind of corruption, so that it can be checked with errors.Is
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// fieldReader reads the big endian fields of the serialized objects sequentially
+// The first error is kept and all the following reads return zero values,
+// so that the error needs to be checked only once, after all the fields have been read.
+type fieldReader struct {
+	reader *bytes.Reader
+	err    error
+}
+
+func newFieldReader(data []byte) *fieldReader {
+	return &fieldReader{reader: bytes.NewReader(data)}
+}
+
+// records the first error
+func (fr *fieldReader) fail(field string, err error) {
+	if fr.err == nil {
+		fr.err = &DecodeError{Field: field, Err: err}
+	}
+}
+
+// reads a 4 bytes integer
+func (fr *fieldReader) readInt(field string) int {
+	var b [4]byte
+	if fr.err != nil {
+		return 0
+	}
+	if _, err := io.ReadFull(fr.reader, b[:]); err != nil {
+		fr.fail(field, TruncatedDataError)
+		return 0
+	}
+	return bigendian.FromInt(b)
+}
+
+// reads a 8 bytes unsigned integer
+func (fr *fieldReader) readUint64(field string) uint64 {
+	var b [8]byte
+	if fr.err != nil {
+		return 0
+	}
+	if _, err := io.ReadFull(fr.reader, b[:]); err != nil {
+		fr.fail(field, TruncatedDataError)
+		return 0
+	}
+	return bigendian.FromUint64(b)
+}
+
+// reads size bytes, the size is checked against the remaining data
+func (fr *fieldReader) readBytes(field string, size int) []byte {
+	if fr.err != nil {
+		return nil
+	}
+	if size < 0 || size > fr.reader.Len() {
+		fr.fail(field, InvalidLengthError)
+		return nil
+	}
+	data := make([]byte, size)
+	fr.reader.Read(data)
+	return data
+}
+
+// reads a 4 bytes size followed by the sized bytes
+func (fr *fieldReader) readSized(field string) []byte {
+	return fr.readBytes(field, fr.readInt(field+"_size"))
+}
+
+// records InvalidValueError if the value is not valid
+func (fr *fieldReader) check(field string, valid bool) {
+	if fr.err == nil && !valid {
+		fr.fail(field, InvalidValueError)
+	}
+}
+
+// returns the amount of bytes not read yet
+func (fr *fieldReader) remaining() int {
+	return fr.reader.Len()
+}
+
+// checks that all the data has been read and returns the first error
+func (fr *fieldReader) close() error {
+	if fr.err == nil && fr.reader.Len() > 0 {
+		fr.fail("end", TrailingDataError)
+	}
+	return fr.err
+}
@@ -0,0 +1,146 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+// validTOTPData returns the clear text serialization of a totp, in the current format
+func validTOTPData(t testing.TB) []byte {
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 7, WithClock(clock), WithLockoutPolicy(NewExponentialLockout(5, time.Minute, time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := otp.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeErrors(t *testing.T) {
+
+	data := validTOTPData(t)
+	body := data[8:]
+
+	setInt := func(data []byte, offset, value int) []byte {
+		corrupted := append([]byte(nil), data...)
+		b := bigendian.ToInt(value)
+		copy(corrupted[offset:], b[:])
+		return corrupted
+	}
+
+	// offsets in the body: total_bytes 0, key_size 4, key 8, counter 8+k, digits 16+k
+	keySize := bigendian.FromInt([4]byte{body[4], body[5], body[6], body[7]})
+
+	tests := []struct {
+		name  string
+		data  []byte
+		field string
+		kind  error
+	}{
+		{"truncated header", data[:2], "total_bytes", TruncatedDataError},
+		{"truncated", data[:len(data)-1], "total_bytes", InvalidValueError},
+		{"trailing", append(append([]byte(nil), data...), 0), "total_bytes", InvalidValueError},
+		{"key size", append(data[:8:8], setInt(body, 4, 1<<30)...), "key", InvalidLengthError},
+		{"empty key", append(data[:8:8], setInt(setInt(body[:8+keySize], 4, 0)[:8], 0, 8)...), "key", InvalidValueError},
+		{"digits", append(data[:8:8], setInt(body, 16+keySize, 42)...), "digits", InvalidValueError},
+		{"legacy trailing", setInt(append(append([]byte(nil), body...), 1, 2, 3), 0, len(body)+3), "end", TrailingDataError},
+	}
+
+	for _, test := range tests {
+		otp, err := deserializeTOTP(test.data)
+		if otp != nil {
+			t.Errorf("%s: a partial totp has been returned\n", test.name)
+		}
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) || decodeErr.Field != test.field || !errors.Is(err, test.kind) {
+			t.Errorf("%s: expected %v on the field %s, instead we've got %v\n", test.name, test.kind, test.field, err)
+		}
+	}
+
+}
+
+func TestDecodeCounters(t *testing.T) {
+
+	// the counters drive loops of the validation and of the lockout policies, the values out of the int32 range are refused
+	tests := []struct {
+		field   string
+		corrupt func(*Totp)
+	}{
+		{"total_failures", func(otp *Totp) { otp.totalVerificationFailures = -1 }},
+		{"lockout_max_failures", func(otp *Totp) { otp.lockout = &exponentialLockout{maxFailures: -1, maxBackoff: time.Hour} }},
+		{"lockouts", func(otp *Totp) { otp.lockouts = -1 }},
+	}
+
+	for _, test := range tests {
+		clock := &fakeClock{now: time.Unix(1234567890, 0)}
+		otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithLockoutPolicy(NewExponentialLockout(3, 0, time.Hour)))
+		checkError(t, err)
+		test.corrupt(otp)
+		data, err := otp.serialize()
+		checkError(t, err)
+		var decodeErr *DecodeError
+		if _, err := deserializeTOTP(data); !errors.As(err, &decodeErr) || decodeErr.Field != test.field || !errors.Is(err, InvalidValueError) {
+			t.Errorf("Expected the invalid value error on the field %s, instead we've got %v\n", test.field, err)
+		}
+	}
+
+}
+
+func TestDecodeNeverPanics(t *testing.T) {
+
+	data := validTOTPData(t)
+
+	// every truncation
+	for i := 0; i < len(data); i++ {
+		if otp, err := deserializeTOTP(data[:i]); err == nil || otp != nil {
+			t.Fatalf("The data truncated at %d has been accepted\n", i)
+		}
+	}
+
+	// every byte set to the values which break the lengths and the enums
+	for i := 0; i < len(data); i++ {
+		for _, value := range []byte{0x00, 0x01, 0x7F, 0x80, 0xFF} {
+			corrupted := append([]byte(nil), data...)
+			corrupted[i] = value
+			checkDecoded(t, corrupted)
+		}
+	}
+
+}
+
+// checkDecoded checks the consistency of the decoder result
+// a successfully decoded totp must serialize to data which decodes to the same totp
+func checkDecoded(t *testing.T, data []byte) {
+	otp, err := deserializeTOTP(data)
+	if err != nil {
+		if otp != nil {
+			t.Fatal("A partial totp has been returned with the error")
+		}
+		return
+	}
+	// the lockout state of the decoded values must be computable, a crafted counter can't make it loop
+	otp.LockedUntil()
+	serialized, err := otp.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := deserializeTOTP(serialized)
+	if err != nil {
+		t.Fatalf("The serialized decoded totp can not be decoded: %v\n%x\n", err, data)
+	}
+	reserialized, err := decoded.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serialized, reserialized) {
+		t.Fatalf("The decoded totp does not serialize back to the same data:\n%x\n%x\n", serialized, reserialized)
+	}
+}
@@ -0,0 +1,307 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+const (
+	recovery_message_type = 2                                  // this is the message type for the crypto engine when serializing the recovery codes
+	recovery_codes        = 10                                 // default amount of recovery codes
+	max_recovery_codes    = 100                                // upper bound of the amount of recovery codes
+	recovery_code_length  = 12                                 // characters of a recovery code, each character carries 5 bits: 60 bits of entropy
+	recovery_group_length = 4                                  // the code is displayed in groups of characters separated by a dash
+	recovery_salt_size    = 16                                 // size of the random salt of the hashes
+	recovery_alphabet     = "0123456789abcdefghjkmnpqrstvwxyz" // Crockford's base32 alphabet: no i, l, o, u to avoid misreading
+)
+
+var (
+	RecoveryCodeError    = errors.New("The recovery code is not valid or it has already been used.")
+	RecoveryAccountError = errors.New("The recovery codes belong to another account than the otp")
+)
+
+// RecoveryCodes holds a set of single use recovery (backup) codes, which can be used
+// instead of the TOTP token when the user loses the device.
+// Only a salted SHA256 hash of each code is stored, the codes are returned in clear text only once, by NewRecoveryCodes.
+// WARNING: The `RecoveryCodes` struct should never be instantiated manually!
+// Use the `NewRecoveryCodes` function
+type RecoveryCodes struct {
+	issuer     string   // the company which issues the 2FA
+	account    string   // usually the user email or the account id
+	salt       []byte   // random salt of the hashes
+	hashes     [][]byte // the hashes of the codes, nil once the code has been used
+	generation uint64   // incremented by each ToBytes, it tells the newer persisted codes from the older ones
+}
+
+// This function creates a new set of recovery codes for the account
+// amount: the amount of codes, between 1 and 100 (by default 10)
+// It returns the recovery codes object, which needs to be persisted via ToBytes, and the codes in clear text,
+// which need to be displayed to the user only once, for instance in the form: abcd-efgh-jkmn
+// The codes are generated using the golang crypto rand package. If there is not enough entropy the function returns an error
+func NewRecoveryCodes(account, issuer string, amount int) (*RecoveryCodes, []string, error) {
+
+	// sanitize the amount of codes
+	if amount < 1 || amount > max_recovery_codes {
+		amount = recovery_codes
+	}
+
+	rc := new(RecoveryCodes)
+	rc.issuer = issuer
+	rc.account = account
+	rc.salt = make([]byte, recovery_salt_size)
+	if _, err := rand.Read(rc.salt); err != nil {
+		return nil, nil, err
+	}
+
+	codes := make([]string, amount)
+	rc.hashes = make([][]byte, amount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code
+		rc.hashes[i] = rc.hash(code)
+	}
+
+	return rc, codes, nil
+}
+
+// Private function which generates a random recovery code, in groups separated by a dash
+func generateRecoveryCode() (string, error) {
+	random := make([]byte, recovery_code_length)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	var code bytes.Buffer
+	for i, b := range random {
+		if i > 0 && i%recovery_group_length == 0 {
+			code.WriteByte('-')
+		}
+		// the alphabet size is a power of 2, therefore there is no modulo bias
+		code.WriteByte(recovery_alphabet[int(b)%len(recovery_alphabet)])
+	}
+	return code.String(), nil
+}
+
+// Private function which returns the salted hash of the code
+// The code is normalized first: the user can type it in upper case, with or without dashes and spaces,
+// and the letters which look like digits are read as the digits, as defined by Crockford's base32
+func (rc *RecoveryCodes) hash(code string) []byte {
+	normalized := strings.NewReplacer("-", "", " ", "", "o", "0", "i", "1", "l", "1").Replace(strings.ToLower(code))
+	h := sha256.New()
+	h.Write(rc.salt)
+	h.Write([]byte(normalized))
+	return h.Sum(nil)
+}
+
+// Remaining returns the amount of recovery codes not used yet
+func (rc *RecoveryCodes) Remaining() int {
+	remaining := 0
+	for _, h := range rc.hashes {
+		if h != nil {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// Validate checks the user provided recovery code and consumes it, so that it can't be used again.
+// The attempts count toward the lockout policy of the otp of the same account: the failures are recorded in the otp,
+// and while the otp is locked the recovery codes are refused as well, with LockDownError.
+// After a successful validation the otp lockout is reset, like after a valid token.
+// The otp must be the one of the same issuer and account, otherwise RecoveryAccountError is returned.
+// Both the otp and the recovery codes need to be persisted afterwards.
+func (rc *RecoveryCodes) Validate(otp *Totp, userCode string) error {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return err
+	}
+
+	if rc == nil || len(rc.salt) == 0 {
+		return initializationFailedError
+	}
+
+	// the codes of an account can't unlock the otp of another one
+	if rc.issuer != otp.issuer || rc.account != otp.account {
+		return RecoveryAccountError
+	}
+
+	// verify that the code is valid
+	if userCode == "" {
+		return ErrEmptyToken
+	}
+
+	t := otp.now()
+
+	// the otp state is updated under its lock
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+
+	// check against the lockout policy of the otp
+	if isLockedOut(otp.lockoutPolicy(), otp.lockoutState(), t) {
+		return LockDownError
+	}
+
+	// all the codes are compared, in constant time
+	userHash := rc.hash(userCode)
+	match := -1
+	for i, h := range rc.hashes {
+		if h != nil && subtle.ConstantTimeCompare(h, userHash) == 1 {
+			match = i
+		}
+	}
+
+	if match < 0 {
+		otp.fail(t)
+		return RecoveryCodeError
+	}
+
+	// consume the code
+	rc.hashes[match] = nil
+	otp.setLockoutState(LockoutState{})
+	return nil
+}
+
+// ToBytes serialises the recovery codes in a byte array
+// Sizes:         4         4        N         4          N        4       N       4           1   32         8
+// Format: |total_bytes|issuer_size|issuer|account_size|account|salt_size|salt|codes_count|[used|hash]...|generation|
+// used: 1 if the code has been used, in that case the hash is all zeros
+// generation: incremented by each call, see GenerationTracker
+// The data is encrypted using the cryptoengine library, the same way as the Totp.
+// The options are the ones of TOTPFromBytes, for instance WithKeyStore, WithKeyring or WithBindingContext.
+// With WithGenerationTracker the new generation is recorded right away: the bytes need to be stored,
+// otherwise the ones stored before are refused by RecoveryCodesFromBytes with RollbackError.
+func (rc *RecoveryCodes) ToBytes(options ...TotpOption) ([]byte, error) {
+
+	if rc == nil || len(rc.salt) == 0 {
+		return nil, initializationFailedError
+	}
+
+	settings, err := settingsFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.generation++
+	encrypted, err := encryptBytes(settings.currentKeyring(), rc.issuer, string(rc.serialize()), recovery_message_type, settings.bindingContext)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.generationTracker != nil {
+		if err := settings.generationTracker.Observe(rc.label(), rc.generation); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// Private function which returns the key of the recovery codes in the generation tracker,
+// which differs from the one of the Totp of the same account
+func (rc *RecoveryCodes) label() string {
+	return formatLabel(rc.issuer, rc.account) + "#recovery"
+}
+
+// Private function which serializes the recovery codes in clear text, in the format described in ToBytes
+func (rc *RecoveryCodes) serialize() []byte {
+	var buffer bytes.Buffer
+
+	totalSize := 4 + 4 + len(rc.issuer) + 4 + len(rc.account) + 4 + len(rc.salt) + 4 + len(rc.hashes)*(1+sha256.Size) + 8
+	totalSizeBytes := bigendian.ToInt(totalSize)
+	issuerSizeBytes := bigendian.ToInt(len(rc.issuer))
+	accountSizeBytes := bigendian.ToInt(len(rc.account))
+	saltSizeBytes := bigendian.ToInt(len(rc.salt))
+	countBytes := bigendian.ToInt(len(rc.hashes))
+
+	// bytes.Buffer writes never return an error, they panic if the buffer becomes too large
+	buffer.Write(totalSizeBytes[:])
+	buffer.Write(issuerSizeBytes[:])
+	buffer.WriteString(rc.issuer)
+	buffer.Write(accountSizeBytes[:])
+	buffer.WriteString(rc.account)
+	buffer.Write(saltSizeBytes[:])
+	buffer.Write(rc.salt)
+	buffer.Write(countBytes[:])
+	for _, h := range rc.hashes {
+		if h == nil {
+			buffer.WriteByte(1)
+			buffer.Write(make([]byte, sha256.Size))
+			continue
+		}
+		buffer.WriteByte(0)
+		buffer.Write(h)
+	}
+	generationBytes := bigendian.ToUint64(rc.generation)
+	buffer.Write(generationBytes[:])
+
+	return buffer.Bytes()
+}
+
+// RecoveryCodesFromBytes converts a byte array to a recovery codes object
+// The options are the ones passed to ToBytes. With WithGenerationTracker the codes older than the last ones seen
+// are refused with RollbackError, so that the used codes can't be brought back by restoring an old copy of the bytes.
+// The bytes serialized by the previous versions have no generation, they are parsed with the generation 0.
+func RecoveryCodesFromBytes(encryptedMessage []byte, issuer string, options ...TotpOption) (*RecoveryCodes, error) {
+
+	settings, err := settingsFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// decrypt the message
+	data, err := decryptBytes(settings.currentKeyring(), issuer, encryptedMessage, recovery_message_type, settings.bindingContext)
+	if err != nil {
+		return nil, err
+	}
+
+	fr := newFieldReader(data)
+	rc := new(RecoveryCodes)
+
+	totalSize := fr.readInt("total_bytes")
+	fr.check("total_bytes", totalSize == len(data))
+	rc.issuer = string(fr.readSized("issuer"))
+	rc.account = string(fr.readSized("account"))
+	rc.salt = fr.readSized("salt")
+	fr.check("salt", len(rc.salt) > 0)
+	count := fr.readInt("codes_count")
+	fr.check("codes_count", count >= 0 && count <= max_recovery_codes)
+	if fr.err != nil {
+		return nil, fr.err
+	}
+
+	rc.hashes = make([][]byte, count)
+	for i := range rc.hashes {
+		used := fr.readBytes("used", 1)
+		hash := fr.readBytes("hash", sha256.Size)
+		if fr.err != nil {
+			return nil, fr.err
+		}
+		fr.check("used", used[0] <= 1)
+		if used[0] == 0 {
+			rc.hashes[i] = hash
+		}
+	}
+	if fr.remaining() > 0 {
+		rc.generation = fr.readUint64("generation")
+	}
+	if err := fr.close(); err != nil {
+		return nil, err
+	}
+
+	// refuse the older codes
+	if settings.generationTracker != nil {
+		if err := settings.generationTracker.Observe(rc.label(), rc.generation); err != nil {
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
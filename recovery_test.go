@@ -0,0 +1,200 @@
+package twofactor
+
+import (
+	"crypto"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sec51/convert/bigendian"
+	"github.com/sec51/cryptoengine"
+)
+
+var recoveryCodeRegEx = regexp.MustCompile("^[0-9a-hjkmnp-tv-z]{4}-[0-9a-hjkmnp-tv-z]{4}-[0-9a-hjkmnp-tv-z]{4}$")
+
+func TestRecoveryCodes(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	rc, codes, err := NewRecoveryCodes("info@sec51.com", "Sec51", 5)
+	checkError(t, err)
+
+	if len(codes) != 5 || rc.Remaining() != 5 {
+		t.Fatalf("Expected 5 recovery codes, instead we've got %d - %d\n", len(codes), rc.Remaining())
+	}
+
+	unique := make(map[string]bool)
+	for _, code := range codes {
+		if !recoveryCodeRegEx.MatchString(code) {
+			t.Errorf("Recovery code with unexpected format: %s\n", code)
+		}
+		unique[code] = true
+	}
+	if len(unique) != len(codes) {
+		t.Error("The recovery codes are not unique")
+	}
+
+	// only the hashes are stored
+	for _, h := range rc.hashes {
+		for _, code := range codes {
+			if strings.Contains(string(h), code) {
+				t.Fatal("The recovery code is stored in clear text")
+			}
+		}
+	}
+
+	// the code is accepted in upper case and without dashes, only once
+	if err := rc.Validate(otp, strings.ToUpper(strings.Replace(codes[2], "-", "", -1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Validate(otp, codes[2]); err != RecoveryCodeError {
+		t.Errorf("Expected the recovery code error, instead we've got %v\n", err)
+	}
+	if err := rc.Validate(otp, ""); err != ErrEmptyToken {
+		t.Errorf("Expected the empty token error, instead we've got %v\n", err)
+	}
+	if rc.Remaining() != 4 {
+		t.Errorf("Expected 4 remaining recovery codes, instead we've got %d\n", rc.Remaining())
+	}
+
+	// the state survives the serialization
+	data, err := rc.ToBytes()
+	checkError(t, err)
+	restored, err := RecoveryCodesFromBytes(data, "Sec51")
+	checkError(t, err)
+	if restored.Remaining() != 4 {
+		t.Errorf("Expected 4 remaining recovery codes after deserialization, instead we've got %d\n", restored.Remaining())
+	}
+	if err := restored.Validate(otp, codes[2]); err != RecoveryCodeError {
+		t.Errorf("Expected the recovery code error after deserialization, instead we've got %v\n", err)
+	}
+	if err := restored.Validate(otp, codes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// recovery codes and totp bytes can not be mixed
+	if _, err := TOTPFromBytes(data, "Sec51"); err == nil {
+		t.Error("Recovery codes bytes were parsed as TOTP")
+	}
+
+}
+
+func TestRecoveryCodesLockout(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	rc, codes, err := NewRecoveryCodes("info@sec51.com", "Sec51", 0)
+	checkError(t, err)
+	if len(codes) != recovery_codes {
+		t.Errorf("Expected the default amount of recovery codes, instead we've got %d\n", len(codes))
+	}
+
+	// the failures of the tokens and of the recovery codes add up
+	otp.Validate("00000000")
+	otp.Validate("00000000")
+	if err := rc.Validate(otp, "0000-0000-0000"); err != RecoveryCodeError {
+		t.Errorf("Expected the recovery code error, instead we've got %v\n", err)
+	}
+	if err := rc.Validate(otp, codes[0]); err != LockDownError {
+		t.Fatalf("Expected the lock down error, instead we've got %v\n", err)
+	}
+	if rc.Remaining() != recovery_codes {
+		t.Error("A recovery code has been consumed while locked")
+	}
+
+	// once the lock expired the valid code resets the lockout
+	clock.Advance(backoff_minutes*time.Minute + time.Second)
+	otp.Validate("00000000")
+	if err := rc.Validate(otp, codes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if otp.totalVerificationFailures != 0 {
+		t.Errorf("totalVerificationFailures counter not reset to zero. We've got: %d\n", otp.totalVerificationFailures)
+	}
+
+}
+
+func TestRecoveryCodesAccount(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	otp.Validate("00000000")
+
+	// the codes of another account can't unlock the otp
+	rc, codes, err := NewRecoveryCodes("other@sec51.com", "Sec51", 1)
+	checkError(t, err)
+	if err := rc.Validate(otp, codes[0]); err != RecoveryAccountError {
+		t.Errorf("Expected the recovery account error, instead we've got %v\n", err)
+	}
+	rc, codes, err = NewRecoveryCodes("info@sec51.com", "Other", 1)
+	checkError(t, err)
+	if err := rc.Validate(otp, codes[0]); err != RecoveryAccountError {
+		t.Errorf("Expected the recovery account error for another issuer, instead we've got %v\n", err)
+	}
+	if rc.Remaining() != 1 || otp.totalVerificationFailures != 1 {
+		t.Error("The recovery codes of another account changed the state")
+	}
+
+}
+
+func TestRecoveryCodesOptions(t *testing.T) {
+
+	store := cryptoengine.NewMemoryKeyStore()
+	context := NewBindingContext("recovery", "info@sec51.com")
+	tracker := NewMemoryGenerationTracker()
+	options := []TotpOption{WithKeyStore(store), WithBindingContext(context), WithGenerationTracker(tracker)}
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	rc, codes, err := NewRecoveryCodes("info@sec51.com", "Sec51", 2)
+	checkError(t, err)
+
+	old, err := rc.ToBytes(options...)
+	checkError(t, err)
+
+	// the options are needed to decrypt the codes
+	if _, err := RecoveryCodesFromBytes(old, "Sec51", WithKeyStore(store)); err == nil {
+		t.Error("The recovery codes have been decrypted without the binding context")
+	}
+	restored, err := RecoveryCodesFromBytes(old, "Sec51", options...)
+	checkError(t, err)
+
+	// a used code can't be brought back by restoring the old bytes
+	checkError(t, restored.Validate(otp, codes[0]))
+	current, err := restored.ToBytes(options...)
+	checkError(t, err)
+	if _, err := RecoveryCodesFromBytes(old, "Sec51", options...); err != RollbackError {
+		t.Errorf("Expected the rollback error, instead we've got %v\n", err)
+	}
+	restored, err = RecoveryCodesFromBytes(current, "Sec51", options...)
+	checkError(t, err)
+	if restored.Remaining() != 1 || restored.generation != 2 {
+		t.Errorf("Unexpected recovery codes: %d remaining, generation %d\n", restored.Remaining(), restored.generation)
+	}
+
+	// the codes serialized by the previous versions have no generation
+	legacy := restored.serialize()
+	legacy = legacy[:len(legacy)-8]
+	legacySize := bigendian.ToInt(len(legacy))
+	copy(legacy, legacySize[:])
+	encrypted, err := encryptBytes(NewKeyring(store), "Sec51", string(legacy), recovery_message_type, nil)
+	checkError(t, err)
+	legacyCodes, err := RecoveryCodesFromBytes(encrypted, "Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if legacyCodes.Remaining() != 1 || legacyCodes.generation != 0 {
+		t.Errorf("Unexpected legacy recovery codes: %d remaining, generation %d\n", legacyCodes.Remaining(), legacyCodes.generation)
+	}
+
+	// the generation of the codes is tracked apart from the one of the otp
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	if _, err := TOTPFromBytes(data, "Sec51", WithGenerationTracker(tracker)); err != nil {
+		t.Errorf("The otp generation has been mixed with the recovery codes one: %v\n", err)
+	}
+
+}
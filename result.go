@@ -0,0 +1,80 @@
+package twofactor
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	max_simulated_failures = 100 // the failures simulated to find the remaining attempts, above it the attempts are considered unlimited
+)
+
+var (
+	ErrEmptyToken = errors.New("User provided token is empty")
+	ErrMismatch   = errors.New("Tokens mismatch.")
+	ErrLockedOut  = LockDownError // the verification is locked, the error returned by ValidateResult is a *LockedOutError
+)
+
+// LockedOutError is returned by ValidateResult when the verification is locked by the lockout policy
+// errors.Is(err, ErrLockedOut) is true for it
+type LockedOutError struct {
+	RetryAfter time.Duration // the time to wait before the verification is accepted again
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("%s Retry after %s.", LockDownError, e.RetryAfter)
+}
+
+// Unwrap returns ErrLockedOut, so that the error can be checked with errors.Is
+func (e *LockedOutError) Unwrap() error {
+	return ErrLockedOut
+}
+
+// ValidationResult reports the details of a verification, see ValidateResult
+type ValidationResult struct {
+	Offset            int           // the step of the matched token, relative to the current one: -1 is the previous step
+	Drift             time.Duration // the clock drift of the device, detected from the matched step
+	RemainingAttempts int           // the failures allowed before the verification is locked, -1 if the policy never locks
+	LockedUntil       time.Time     // the time until which the verification is locked, the zero time if it is not locked
+	Changed           bool          // the state of the Totp changed, it needs to be persisted
+}
+
+// Private function which builds the result of the verification at the time t, with the lock held
+func (otp *Totp) result(t time.Time, offset int, changed bool) ValidationResult {
+	policy := otp.lockoutPolicy()
+	state := otp.lockoutState()
+
+	result := ValidationResult{
+		Offset:            offset,
+		Drift:             time.Duration(offset*otp.stepSize) * time.Second,
+		RemainingAttempts: remainingAttempts(policy, state, t),
+		Changed:           changed,
+	}
+	if isLockedOut(policy, state, t) {
+		result.LockedUntil = policy.LockedUntil(state)
+	}
+	return result
+}
+
+// Private function which returns the failures allowed at the time t before the verification is locked
+// The built-in policies lock after their max failures, the failures since the expired lock don't count.
+// The failures of the custom policies are simulated. It returns -1 if the policy never locks.
+func remainingAttempts(policy LockoutPolicy, state LockoutState, t time.Time) int {
+	if isLockedOut(policy, state, t) {
+		return 0
+	}
+	if policyType, maxFailures, _, _ := lockoutPolicyToValues(policy); policyType != lockout_custom {
+		if state.Failures >= maxFailures {
+			return maxFailures
+		}
+		return maxFailures - state.Failures
+	}
+	for attempts := 0; attempts < max_simulated_failures; attempts++ {
+		if isLockedOut(policy, state, t) {
+			return attempts
+		}
+		state = policy.Fail(state, t.UTC())
+	}
+	return -1
+}
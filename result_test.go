@@ -0,0 +1,93 @@
+package twofactor
+
+import (
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidationResult(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	if result, err := otp.ValidateResult(""); err != ErrEmptyToken || result.Changed {
+		t.Errorf("Expected the empty token error, instead we've got %v - %+v\n", err, result)
+	}
+
+	// the failures reduce the remaining attempts
+	result, err := otp.ValidateResult("00000000")
+	if !errors.Is(err, ErrMismatch) || !result.Changed || result.RemainingAttempts != max_failures-1 || !result.LockedUntil.IsZero() {
+		t.Errorf("Unexpected mismatch result: %v - %+v\n", err, result)
+	}
+
+	// the token of the previous step reports the drift
+	previous, err := otp.OTPAt(clock.Now().Add(-step_size * time.Second))
+	checkError(t, err)
+	result, err = otp.ValidateResult(previous)
+	checkError(t, err)
+	if result.Offset != -1 || result.Drift != -step_size*time.Second || result.RemainingAttempts != max_failures || !result.Changed {
+		t.Errorf("Unexpected result: %+v\n", result)
+	}
+
+	// the replay is reported
+	if _, err := otp.ValidateResult(previous); !errors.Is(err, TokenReplayError) {
+		t.Errorf("Expected the token replay error, instead we've got %v\n", err)
+	}
+
+	// the lock tells when to retry
+	otp.ValidateResult("00000000")
+	result, err = otp.ValidateResult("00000000")
+	if result.RemainingAttempts != 0 || !result.LockedUntil.Equal(clock.Now().Add(backoff_minutes*time.Minute)) {
+		t.Errorf("Unexpected locking result: %+v\n", result)
+	}
+	clock.Advance(time.Minute)
+	result, err = otp.ValidateResult("00000000")
+	var lockedErr *LockedOutError
+	if !errors.Is(err, ErrLockedOut) || !errors.As(err, &lockedErr) || result.Changed {
+		t.Fatalf("Expected the locked out error, instead we've got %v - %+v\n", err, result)
+	}
+	if lockedErr.RetryAfter != (backoff_minutes-1)*time.Minute {
+		t.Errorf("Expected to retry after %d minutes, instead we've got %s\n", backoff_minutes-1, lockedErr.RetryAfter)
+	}
+
+	// Validate keeps returning the sentinel errors
+	if err := otp.Validate("00000000"); err != LockDownError {
+		t.Errorf("Expected the lock down error, instead we've got %v\n", err)
+	}
+
+	// once the lock expired all the attempts are allowed again
+	clock.Advance(backoff_minutes * time.Minute)
+	if attempts := remainingAttempts(otp.lockoutPolicy(), otp.lockoutState(), clock.Now()); attempts != max_failures {
+		t.Errorf("Expected %d attempts after the lock, instead we've got %d\n", max_failures, attempts)
+	}
+
+	// the attempts of the built-in policies are not limited by the simulation of the custom ones
+	many, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithLockoutPolicy(NewFlatLockout(1000, time.Minute)))
+	checkError(t, err)
+	if result, _ := many.ValidateResult("00000000"); result.RemainingAttempts != 999 {
+		t.Errorf("Expected 999 attempts, instead we've got %d\n", result.RemainingAttempts)
+	}
+
+	// a policy which never locks
+	never, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithLockoutPolicy(neverLockout{}))
+	checkError(t, err)
+	if result, _ := never.ValidateResult("00000000"); result.RemainingAttempts != -1 {
+		t.Errorf("Expected unlimited attempts, instead we've got %d\n", result.RemainingAttempts)
+	}
+
+}
+
+// a custom policy which never locks the verification
+type neverLockout struct{}
+
+func (neverLockout) LockedUntil(state LockoutState) time.Time {
+	return time.Time{}
+}
+
+func (neverLockout) Fail(state LockoutState, t time.Time) LockoutState {
+	state.Failures++
+	return state
+}
@@ -0,0 +1,111 @@
+package twofactor
+
+import (
+	"errors"
+
+	"github.com/sec51/cryptoengine"
+)
+
+var (
+	DerivedNonceKeyError = errors.New("The bytes with a derived nonce are encrypted with the active key, RotateKey needs to be called first")
+)
+
+// RotateKey generates a new encryption key for the issuer, used from now on by ToBytes.
+// The old keys are retained, so that the bytes encrypted before the rotation can still be decrypted,
+// until they are re-encrypted with ReencryptTOTPs and the old keys retired with RetireKey.
+// It returns the id of the new key. The options, for instance WithKeyStore or WithKeyring, select the key store.
+func RotateKey(issuer string, options ...TotpOption) (uint32, error) {
+
+	keyring, err := keyringFromOptions(options)
+	if err != nil {
+		return 0, err
+	}
+
+	return keyring.RotateKey(issuer)
+}
+
+// RetireKey deletes an old encryption key of the issuer: the bytes encrypted with it can not be decrypted anymore.
+// The bytes need to be re-encrypted with ReencryptTOTPs first. The active key can not be retired.
+// The options, for instance WithKeyStore or WithKeyring, select the key store, like for RotateKey.
+func RetireKey(issuer string, keyID uint32, options ...TotpOption) error {
+
+	keyring, err := keyringFromOptions(options)
+	if err != nil {
+		return err
+	}
+
+	return keyring.RetireKey(issuer, keyID)
+}
+
+// ReencryptTOTP re-encrypts the bytes created by ToBytes with the active key of the issuer, see ReencryptTOTPs
+func ReencryptTOTP(encryptedMessage []byte, issuer string, options ...TotpOption) ([]byte, bool, error) {
+	reencrypted, changed, err := ReencryptTOTPs([][]byte{encryptedMessage}, issuer, options...)
+	if err != nil {
+		return nil, false, err
+	}
+	return reencrypted[0], changed == 1, nil
+}
+
+// ReencryptTOTPs re-encrypts, after a key rotation, the bytes created by ToBytes with the active key of the issuer.
+// The serialized Totp is not modified, only the encryption. The bytes already encrypted with the active key are returned as they are,
+// The bytes encrypted by the previous versions of the package had a nonce derived from a counter which restarted at zero
+// with each ToBytes call, so the same nonce was used for all the bytes of the issuer. Since their key can't be trusted anymore,
+// they are refused with DerivedNonceKeyError while it is still the active key: RotateKey needs to be called first,
+// then they are re-encrypted with the new key and a random nonce, and the old key can be retired afterwards.
+// It returns the bytes to be stored, in the same order, and the amount of them which changed.
+// The options, for instance WithKeyStore or WithKeyring, are the ones of TOTPFromBytes.
+// With WithBindingContext all the bytes need to be bound to that context, the bytes of different accounts need a ReencryptTOTP call each.
+func ReencryptTOTPs(encryptedMessages [][]byte, issuer string, options ...TotpOption) ([][]byte, int, error) {
+
+	settings, err := settingsFromOptions(options)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the engine is shared by all the messages
+	engine, err := settings.currentKeyring().engine(issuer)
+	if err != nil {
+		return nil, 0, err
+	}
+	activeKeyID := engine.ActiveKeyID()
+
+	changed := 0
+	reencrypted := make([][]byte, len(encryptedMessages))
+	for i, encryptedMessage := range encryptedMessages {
+
+		keyID, err := cryptoengine.MessageKeyID(encryptedMessage)
+		if err != nil {
+			return nil, 0, err
+		}
+		randomNonce, err := cryptoengine.MessageHasRandomNonce(encryptedMessage)
+		if err != nil {
+			return nil, 0, err
+		}
+		if keyID == activeKeyID {
+			if !randomNonce {
+				return nil, 0, DerivedNonceKeyError
+			}
+			reencrypted[i] = encryptedMessage
+			continue
+		}
+
+		message, err := engine.DecryptWithAssociatedData(encryptedMessage, settings.bindingContext)
+		if err != nil {
+			return nil, 0, err
+		}
+		if message.Type != message_type {
+			return nil, 0, messageTypeError
+		}
+
+		encrypted, err := engine.NewEncryptedMessageWithAssociatedData(*message, settings.bindingContext)
+		if err != nil {
+			return nil, 0, err
+		}
+		if reencrypted[i], err = encrypted.ToBytes(); err != nil {
+			return nil, 0, err
+		}
+		changed++
+	}
+
+	return reencrypted, changed, nil
+}
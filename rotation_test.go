@@ -0,0 +1,191 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sec51/cryptoengine"
+)
+
+func TestKeyRotation(t *testing.T) {
+
+	store := cryptoengine.NewMemoryKeyStore()
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithKeyStore(store))
+	checkError(t, err)
+
+	old, err := otp.ToBytes()
+	checkError(t, err)
+	if keyID, err := cryptoengine.MessageKeyID(old); err != nil || keyID != 0 {
+		t.Fatalf("Expected the key id 0, instead we've got %d - %v\n", keyID, err)
+	}
+
+	// the messages of the previous versions, without the key id and the random nonce flags, are encrypted with the key 0
+	legacy := append(append([]byte(nil), old[:8]...), old[12:]...)
+	legacy[7] &^= 0xC0
+	_, err = TOTPFromBytes(legacy, "Sec51", WithKeyStore(store))
+	checkError(t, err)
+
+	keyID, err := RotateKey("Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if keyID != 1 {
+		t.Fatalf("Expected the key id 1, instead we've got %d\n", keyID)
+	}
+
+	// the new bytes are encrypted with the new key, the old ones can still be decrypted
+	current, err := otp.ToBytes()
+	checkError(t, err)
+	if keyID, _ := cryptoengine.MessageKeyID(current); keyID != 1 {
+		t.Errorf("Expected the key id 1, instead we've got %d\n", keyID)
+	}
+	_, err = TOTPFromBytes(old, "Sec51", WithKeyStore(store))
+	checkError(t, err)
+
+	// the old bytes are re-encrypted, the current ones are left as they are
+	reencrypted, changed, err := ReencryptTOTPs([][]byte{old, current}, "Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if changed != 1 || !bytes.Equal(reencrypted[1], current) {
+		t.Errorf("Expected only the old bytes to be re-encrypted, instead %d changed\n", changed)
+	}
+	if keyID, _ := cryptoengine.MessageKeyID(reencrypted[0]); keyID != 1 {
+		t.Errorf("Expected the re-encrypted key id 1, instead we've got %d\n", keyID)
+	}
+	restored, err := TOTPFromBytes(reencrypted[0], "Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if restored.Secret() != otp.Secret() {
+		t.Error("The re-encrypted secret differs from the original one")
+	}
+	if _, changed, err := ReencryptTOTP(reencrypted[0], "Sec51", WithKeyStore(store)); err != nil || changed {
+		t.Errorf("The bytes encrypted with the active key have been re-encrypted: %v\n", err)
+	}
+
+	// once the old key is retired the old bytes can not be decrypted anymore
+	if err := RetireKey("Sec51", 1, WithKeyStore(store)); err == nil {
+		t.Error("The active key has been retired")
+	}
+	checkError(t, RetireKey("Sec51", 0, WithKeyStore(store)))
+	if _, err := TOTPFromBytes(old, "Sec51", WithKeyStore(store)); err == nil {
+		t.Error("The bytes encrypted with a retired key have been decrypted")
+	}
+	_, err = TOTPFromBytes(reencrypted[0], "Sec51", WithKeyStore(store))
+	checkError(t, err)
+
+	// other message types are not re-encrypted
+	rc, _, err := NewRecoveryCodes("info@sec51.com", "Sec51", 1)
+	checkError(t, err)
+	SetKeyStore(store)
+	defer SetKeyStore(nil)
+	rcData, err := rc.ToBytes()
+	checkError(t, err)
+	RotateKey("Sec51")
+	if _, _, err := ReencryptTOTP(rcData, "Sec51"); err != messageTypeError {
+		t.Errorf("Expected the message type error, instead we've got %v\n", err)
+	}
+
+}
+
+func TestFileKeyStoreRotation(t *testing.T) {
+
+	path, err := ioutil.TempDir("", "twofactor")
+	checkError(t, err)
+	defer os.RemoveAll(path)
+
+	store := cryptoengine.NewFileKeyStore(path)
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithKeyStore(store))
+	checkError(t, err)
+	old, err := otp.ToBytes()
+	checkError(t, err)
+
+	// the active key id is replaced in place, each rotation is read back by the next one
+	for want := uint32(1); want <= 2; want++ {
+		keyID, err := RotateKey("Sec51", WithKeyStore(store))
+		checkError(t, err)
+		if keyID != want {
+			t.Fatalf("Expected the key id %d, instead we've got %d\n", want, keyID)
+		}
+	}
+
+	// a new store on the same folder, like after a restart, picks up the active key
+	restarted := cryptoengine.NewFileKeyStore(path)
+	engine, err := cryptoengine.InitCryptoEngineWithKeyStore("Sec51", restarted)
+	checkError(t, err)
+	if engine.ActiveKeyID() != 2 {
+		t.Errorf("Expected the active key id 2, instead we've got %d\n", engine.ActiveKeyID())
+	}
+	current, err := otp.ToBytesWith(NewKeyring(restarted))
+	checkError(t, err)
+	if keyID, _ := cryptoengine.MessageKeyID(current); keyID != 2 {
+		t.Errorf("Expected the key id 2, instead we've got %d\n", keyID)
+	}
+	_, err = TOTPFromBytes(old, "Sec51", WithKeyStore(restarted))
+	checkError(t, err)
+
+	// the key left by an interrupted rotation is adopted
+	checkError(t, restarted.Store("sec51_secret_3.key", make([]byte, 32)))
+	keyID, err := engine.RotateKey()
+	checkError(t, err)
+	if keyID != 3 {
+		t.Errorf("Expected the key id 3, instead we've got %d\n", keyID)
+	}
+
+	// no temporary file is left behind
+	files, err := ioutil.ReadDir(path)
+	checkError(t, err)
+	for _, file := range files {
+		if file.Mode().Perm() != 0400 {
+			t.Errorf("The key file %s has the permissions %s\n", file.Name(), file.Mode().Perm())
+		}
+	}
+	if len(files) != 9 {
+		t.Errorf("Expected 9 key files, instead we've got %d\n", len(files))
+	}
+
+}
+
+func TestDerivedNonceMigration(t *testing.T) {
+
+	store := cryptoengine.NewMemoryKeyStore()
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithKeyStore(store))
+	checkError(t, err)
+
+	// the nonces never repeat, even if each ToBytes creates a new engine
+	first, err := otp.ToBytes()
+	checkError(t, err)
+	second, err := otp.ToBytes()
+	checkError(t, err)
+	if bytes.Equal(first[12:36], second[12:36]) {
+		t.Fatal("The same nonce has been used twice")
+	}
+	if random, err := cryptoengine.MessageHasRandomNonce(first); err != nil || !random {
+		t.Fatalf("Expected a random nonce: %v\n", err)
+	}
+
+	// the bytes of the previous versions have a derived nonce, their key needs to be rotated first
+	derived := append([]byte(nil), first...)
+	derived[7] &^= 0x40
+	if random, _ := cryptoengine.MessageHasRandomNonce(derived); random {
+		t.Fatal("The derived nonce has been reported as random")
+	}
+	if _, _, err := ReencryptTOTPs([][]byte{derived, second}, "Sec51", WithKeyStore(store)); err != DerivedNonceKeyError {
+		t.Fatalf("Expected the derived nonce key error, instead we've got %v\n", err)
+	}
+
+	_, err = RotateKey("Sec51", WithKeyStore(store))
+	checkError(t, err)
+	reencrypted, changed, err := ReencryptTOTPs([][]byte{derived, second}, "Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if changed != 2 {
+		t.Errorf("Expected the bytes of the old key to be re-encrypted, instead %d changed\n", changed)
+	}
+	if random, _ := cryptoengine.MessageHasRandomNonce(reencrypted[0]); !random {
+		t.Error("The re-encrypted bytes have no random nonce")
+	}
+	restored, err := TOTPFromBytes(reencrypted[0], "Sec51", WithKeyStore(store))
+	checkError(t, err)
+	if restored.Secret() != otp.Secret() {
+		t.Error("The re-encrypted secret differs from the original one")
+	}
+
+}
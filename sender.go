@@ -0,0 +1,104 @@
+package twofactor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	twilio_messages_url = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json" // the Twilio endpoint for sending SMS
+	sms_timeout         = 10 * time.Second                                              // the timeout of the SMS gateway requests
+)
+
+// SMTPSender delivers the out of band codes via email, using the SMTP server at Addr
+type SMTPSender struct {
+	Addr    string    // the address of the SMTP server, in the form host:port
+	Auth    smtp.Auth // the authentication mechanism, nil if the server does not require authentication
+	From    string    // the sender email address
+	Subject string    // the subject of the email, by default: "<issuer> verification code"
+}
+
+// Send delivers the message to the destination email address
+func (s *SMTPSender) Send(message OutOfBandMessage) error {
+
+	// avoid header injection via the destination or the issuer
+	if strings.ContainsAny(message.Destination+s.From, "\r\n") {
+		return fmt.Errorf("Invalid email address: %q", message.Destination)
+	}
+
+	subject := s.Subject
+	if subject == "" {
+		subject = fmt.Sprintf("%s verification code", message.Issuer)
+	}
+	subject = strings.NewReplacer("\r", "", "\n", "").Replace(subject)
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		s.From, message.Destination, subject, strings.Replace(message.Text(), "\n", "\r\n", -1))
+
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{message.Destination}, []byte(body))
+}
+
+// SMSSender delivers the out of band codes via SMS, by posting a form to an HTTP gateway.
+// The form fields are To, From and Body, sent with basic authentication, which is the format of the Twilio API.
+// Use NewTwilioSender for Twilio, or set the URL of any compatible gateway.
+type SMSSender struct {
+	URL      string       // the endpoint of the gateway
+	Username string       // the basic authentication user, for Twilio the account SID
+	Password string       // the basic authentication password, for Twilio the auth token
+	From     string       // the phone number the SMS are sent from
+	Client   *http.Client // the HTTP client, by default a client with a 10 seconds timeout
+}
+
+// NewTwilioSender creates an SMSSender for the Twilio messages API
+func NewTwilioSender(accountSid, authToken, from string) *SMSSender {
+	return &SMSSender{
+		URL:      fmt.Sprintf(twilio_messages_url, url.PathEscape(accountSid)),
+		Username: accountSid,
+		Password: authToken,
+		From:     from,
+	}
+}
+
+// Send delivers the message to the destination phone number
+// Any response status other than 2xx is returned as an error
+func (s *SMSSender) Send(message OutOfBandMessage) error {
+
+	form := url.Values{}
+	form.Set("To", message.Destination)
+	form.Set("From", s.From)
+	form.Set("Body", message.Text())
+
+	req, err := http.NewRequest("POST", s.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: sms_timeout}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the body may explain the failure, it is read up to a reasonable size
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("The SMS gateway returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package twofactor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sec51/convert/bigendian"
+)
+
+const (
+	max_store_retries = 5       // the attempts of ValidateAndStore when the stored Totp is modified concurrently
+	store_file_suffix = ".totp" // the extension of the files of the FileStore
+)
+
+var (
+	VersionConflictError = errors.New("The stored data has been modified concurrently")
+	AccountNotFoundError = errors.New("The account does not exist in the store")
+	storeIssuerError     = errors.New("The issuer of the Totp does not match the one of the store")
+)
+
+// Store persists the encrypted bytes of the Totp, as created by ToBytes, keyed by account.
+// The writes use optimistic versioning: every Save increments the version of the account,
+// and a Save based on an old version fails, so that concurrent updates can't overwrite each other.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Load returns the bytes of the account and their version, or AccountNotFoundError
+	Load(account string) ([]byte, uint64, error)
+	// Save stores the bytes if the version of the account is still version, and returns the new version.
+	// The version 0 creates the account. It returns VersionConflictError if the version changed in the meantime.
+	Save(account string, data []byte, version uint64) (uint64, error)
+}
+
+// TotpStore loads, validates and saves the Totp of the accounts of an issuer in a Store
+type TotpStore struct {
+	store   Store
+	issuer  string
+	options []TotpOption
+}
+
+// NewTotpStore creates a TotpStore for the issuer
+// options: the options passed to TOTPFromBytes, for instance WithClock or WithKeyStore.
+// The Totp is saved with the keys and the binding context of the options as well, whatever its own ones.
+// With WithGenerationTracker the store refuses to load a state older than the last one it saved or loaded,
+// for instance an old copy of the bytes restored to reset the lockout, and returns RollbackError.
+func NewTotpStore(store Store, issuer string, options ...TotpOption) *TotpStore {
+	return &TotpStore{store: store, issuer: issuer, options: options}
+}
+
+// Create stores a new Totp, it returns VersionConflictError if the account exists already
+func (s *TotpStore) Create(account string, otp *Totp) error {
+	_, err := s.save(account, otp, 0)
+	return err
+}
+
+// Load returns the Totp of the account and its version
+func (s *TotpStore) Load(account string) (*Totp, uint64, error) {
+	data, version, err := s.store.Load(account)
+	if err != nil {
+		return nil, 0, err
+	}
+	otp, err := TOTPFromBytes(data, s.issuer, s.options...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return otp, version, nil
+}
+
+// Save stores the Totp if the version of the account is still version, and returns the new version
+func (s *TotpStore) Save(account string, otp *Totp, version uint64) (uint64, error) {
+	return s.save(account, otp, version)
+}
+
+// Private function which serializes and stores the Totp, then records its generation in the tracker of the options, if any
+// The Totp of another issuer is refused, the store would not be able to load it.
+func (s *TotpStore) save(account string, otp *Totp, version uint64) (uint64, error) {
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return 0, err
+	}
+
+	if otp.issuer != s.issuer {
+		return 0, storeIssuerError
+	}
+
+	settings, err := settingsFromOptions(s.options)
+	if err != nil {
+		return 0, err
+	}
+
+	// the generation is recorded once it has been stored
+	data, generation, err := otp.encrypt(settings.currentKeyring(), settings.bindingContext, nil)
+	if err != nil {
+		return 0, err
+	}
+	version, err = s.store.Save(account, data, version)
+	if err != nil {
+		return 0, err
+	}
+
+	if settings.generationTracker != nil {
+		if err := settings.generationTracker.Observe(otp.label(), generation); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// ValidateAndStore validates the user provided token against the stored Totp of the account and stores the updated state.
+// If the state has been modified concurrently, for instance by another login of the same account, the validation is repeated
+// with the new state, up to 5 times, then VersionConflictError is returned.
+// It returns the error of Totp.Validate.
+func (s *TotpStore) ValidateAndStore(account, userCode string) error {
+
+	for attempt := 0; attempt < max_store_retries; attempt++ {
+
+		otp, version, err := s.Load(account)
+		if err != nil {
+			return err
+		}
+
+		result, validationErr := otp.ValidateResult(userCode)
+		if errors.Is(validationErr, ErrLockedOut) {
+			validationErr = LockDownError
+		}
+
+		// nothing to store, for instance while the verification is locked
+		if !result.Changed {
+			return validationErr
+		}
+
+		_, err = s.Save(account, otp, version)
+		if err == VersionConflictError {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		return validationErr
+	}
+
+	return VersionConflictError
+}
+
+// MemoryStore is a Store which keeps the data in memory, it is lost when the process exits
+type MemoryStore struct {
+	mutex    sync.Mutex
+	data     map[string][]byte
+	versions map[string]uint64
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte), versions: make(map[string]uint64)}
+}
+
+// Load returns a copy of the bytes of the account and their version
+func (s *MemoryStore) Load(account string) ([]byte, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.data[account]
+	if !ok {
+		return nil, 0, AccountNotFoundError
+	}
+	return append([]byte(nil), data...), s.versions[account], nil
+}
+
+// Save stores a copy of the bytes if the version of the account is still version
+func (s *MemoryStore) Save(account string, data []byte, version uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.versions[account] != version {
+		return 0, VersionConflictError
+	}
+	s.data[account] = append([]byte(nil), data...)
+	s.versions[account] = version + 1
+	return version + 1, nil
+}
+
+// FileStore is a Store which keeps the data of each account in a file, inside a folder.
+// The file name is the SHA256 of the account, the file content is the version followed by the bytes:
+// Sizes:     8      N
+// Format: |version|data|
+// The files are replaced atomically, by renaming a temporary file.
+// The versions are checked under a lock of the process: the folder must not be shared by several processes.
+type FileStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileStore creates a FileStore in the folder path, the folder is created with 0700 permissions if it does not exist
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{path: path}, nil
+}
+
+// returns the file of the account
+func (s *FileStore) file(account string) string {
+	hash := sha256.Sum256([]byte(account))
+	return filepath.Join(s.path, hex.EncodeToString(hash[:])+store_file_suffix)
+}
+
+// Load returns the bytes of the account and their version
+func (s *FileStore) Load(account string) ([]byte, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read(account)
+}
+
+// reads the file of the account, with the lock held
+func (s *FileStore) read(account string) ([]byte, uint64, error) {
+	content, err := ioutil.ReadFile(s.file(account))
+	if os.IsNotExist(err) {
+		return nil, 0, AccountNotFoundError
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fr := newFieldReader(content)
+	version := fr.readUint64("version")
+	data := fr.readBytes("data", fr.remaining())
+	if fr.err != nil {
+		return nil, 0, fr.err
+	}
+	return data, version, nil
+}
+
+// Save stores the bytes if the version of the account is still version
+func (s *FileStore) Save(account string, data []byte, version uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, current, err := s.read(account)
+	if err != nil && err != AccountNotFoundError {
+		return 0, err
+	}
+	if current != version {
+		return 0, VersionConflictError
+	}
+
+	var buffer bytes.Buffer
+	versionBytes := bigendian.ToUint64(version + 1)
+	buffer.Write(versionBytes[:])
+	buffer.Write(data)
+
+	if err := writeFileAtomically(s.path, s.file(account), buffer.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return version + 1, nil
+}
+
+// Private function which writes a temporary file in the folder and renames it to file, so that the file is never partially written
+func writeFileAtomically(folder, file string, data []byte) error {
+	tmp, err := ioutil.TempFile(folder, "tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
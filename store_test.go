@@ -0,0 +1,141 @@
+package twofactor
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sec51/cryptoengine"
+)
+
+// racingStore simulates a concurrent login: before the first Save, another failed validation is stored
+type racingStore struct {
+	Store
+	race func()
+}
+
+func (s *racingStore) Save(account string, data []byte, version uint64) (uint64, error) {
+	if s.race != nil {
+		race := s.race
+		s.race = nil
+		race()
+	}
+	return s.Store.Save(account, data, version)
+}
+
+func testStore(t *testing.T, store Store) {
+
+	if _, _, err := store.Load("info@sec51.com"); err != AccountNotFoundError {
+		t.Fatalf("Expected the account not found error, instead we've got %v\n", err)
+	}
+
+	version, err := store.Save("info@sec51.com", []byte("first"), 0)
+	checkError(t, err)
+	if version != 1 {
+		t.Errorf("Expected the version 1, instead we've got %d\n", version)
+	}
+
+	// the account exists already
+	if _, err := store.Save("info@sec51.com", []byte("other"), 0); err != VersionConflictError {
+		t.Errorf("Expected the version conflict error, instead we've got %v\n", err)
+	}
+
+	version, err = store.Save("info@sec51.com", []byte("second"), version)
+	checkError(t, err)
+
+	// the stale version is refused
+	if _, err := store.Save("info@sec51.com", []byte("stale"), 1); err != VersionConflictError {
+		t.Errorf("Expected the version conflict error, instead we've got %v\n", err)
+	}
+
+	data, loaded, err := store.Load("info@sec51.com")
+	checkError(t, err)
+	if string(data) != "second" || loaded != version {
+		t.Errorf("Unexpected stored data: %s - %d\n", data, loaded)
+	}
+
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path, err := ioutil.TempDir("", "twofactor")
+	checkError(t, err)
+	defer os.RemoveAll(path)
+
+	store, err := NewFileStore(path)
+	checkError(t, err)
+	testStore(t, store)
+}
+
+func TestValidateAndStore(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	memory := NewMemoryStore()
+	store := &racingStore{Store: memory}
+	totpStore := NewTotpStore(store, "Sec51", WithClock(clock))
+	checkError(t, totpStore.Create("info@sec51.com", otp))
+	if err := totpStore.Create("info@sec51.com", otp); err != VersionConflictError {
+		t.Errorf("Expected the version conflict error, instead we've got %v\n", err)
+	}
+
+	// the failure of the concurrent login is not overwritten
+	store.race = func() {
+		other := NewTotpStore(memory, "Sec51", WithClock(clock))
+		concurrent, version, err := other.Load("info@sec51.com")
+		checkError(t, err)
+		concurrent.Validate("00000000")
+		_, err = other.Save("info@sec51.com", concurrent, version)
+		checkError(t, err)
+	}
+	if err := totpStore.ValidateAndStore("info@sec51.com", "00000000"); err == nil {
+		t.Fatal("The wrong token has been accepted")
+	}
+	stored, _, err := totpStore.Load("info@sec51.com")
+	checkError(t, err)
+	if stored.totalVerificationFailures != 2 {
+		t.Errorf("Expected 2 stored failures, instead we've got %d\n", stored.totalVerificationFailures)
+	}
+
+	// the valid token is accepted only once
+	token, err := otp.OTP()
+	checkError(t, err)
+	checkError(t, totpStore.ValidateAndStore("info@sec51.com", token))
+	if err := totpStore.ValidateAndStore("info@sec51.com", token); err != TokenReplayError {
+		t.Errorf("Expected the token replay error, instead we've got %v\n", err)
+	}
+
+	if err := totpStore.ValidateAndStore("unknown", token); err != AccountNotFoundError {
+		t.Errorf("Expected the account not found error, instead we've got %v\n", err)
+	}
+
+}
+
+func TestTotpStoreSettings(t *testing.T) {
+
+	// the totp is saved with the keys and the binding context of the store, not with its own ones
+	keys := NewKeyring(cryptoengine.NewMemoryKeyStore())
+	context := NewBindingContext("users", "42")
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	totpStore := NewTotpStore(NewMemoryStore(), "Sec51", WithKeyring(keys), WithBindingContext(context))
+	checkError(t, totpStore.Create("info@sec51.com", otp))
+	if _, _, err := totpStore.Load("info@sec51.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store loads only the totp of its issuer
+	other, err := NewTOTP("info@sec51.com", "Other", crypto.SHA1, 8)
+	checkError(t, err)
+	if err := totpStore.Create("other@sec51.com", other); err != storeIssuerError {
+		t.Errorf("Expected the store issuer error, instead we've got %v\n", err)
+	}
+
+}
@@ -8,15 +8,13 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base32"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
-	"io"
-	"math"
 	"net/url"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/sec51/convert"
@@ -26,43 +24,75 @@ import (
 )
 
 const (
-	backoff_minutes = 5 // this is the time to wait before verifying another token
-	max_failures    = 3 // total amount of failures, after that the user needs to wait for the backoff time
-	counter_size    = 8 // this is defined in the RFC 4226
-	message_type    = 0 // this is the message type for the crypto engine
+	backoff_minutes = 5   // this is the default time to wait before verifying another token
+	max_failures    = 3   // default total amount of failures, after that the user needs to wait for the backoff time
+	counter_size    = 8   // this is defined in the RFC 4226
+	message_type    = 0   // this is the message type for the crypto engine
+	window_size     = 1   // default amount of steps accepted in the past and in the future
+	max_window_size = 10  // upper bound of the past and future window, a too big window makes brute forcing easier
+	step_size       = 30  // default period in seconds, it's the recommended value from the RFC
+	min_step_size   = 5   // lower bound of the period in seconds
+	max_step_size   = 600 // upper bound of the period in seconds
 )
 
 var (
 	initializationFailedError = errors.New("Totp has not been initialized correctly")
 	LockDownError             = errors.New("The verification is locked down, because of too many trials.")
+	messageTypeError          = errors.New("The decrypted message is not of the expected type")
+	clockError                = errors.New("The clock cannot be nil")
+	TokenReplayError          = errors.New("The token has already been used.")
+	windowSizeError           = errors.New(fmt.Sprintf("The validation window must be between 0 and %d steps", max_window_size))
+	stepSizeError             = errors.New(fmt.Sprintf("The period must be between %d and %d seconds", min_step_size, max_step_size))
 )
 
 // WARNING: The `Totp` struct should never be instantiated manually!
 // Use the `NewTOTP` function
+// A Totp is safe for concurrent use: the tokens are computed from the time and the key only,
+// and the verification state is updated under a lock, so that concurrent validations can't accept the same token twice.
 type Totp struct {
-	key                       []byte             // this is the secret key
-	counter                   [counter_size]byte // this is the counter used to synchronize with the client device
-	digits                    int                // total amount of digits of the code displayed on the device
-	issuer                    string             // the company which issues the 2FA
-	account                   string             // usually the user email or the account id
-	stepSize                  int                // by default 30 seconds
-	clientOffset              int                // the amount of steps the client is off
-	totalVerificationFailures int                // the total amount of verification failures from the client - by default 10
-	lastVerificationTime      time.Time          // the last verification executed
-	hashFunction              crypto.Hash        // the hash function used in the HMAC construction (sha1 - sha156 - sha512)
+	key                       []byte                // this is the secret key
+	counter                   [counter_size]byte    // this is the counter used to synchronize with the client device
+	digits                    int                   // total amount of digits of the code displayed on the device, it's the length of the codes of the formatter
+	formatter                 CodeFormatter         // maps the truncated value to the code, by default the decimal codes
+	issuer                    string                // the company which issues the 2FA
+	account                   string                // usually the user email or the account id
+	stepSize                  int                   // by default 30 seconds
+	clientOffset              int                   // the amount of steps the client is off
+	totalVerificationFailures int                   // the total amount of verification failures from the client, see LockoutState
+	lastVerificationTime      time.Time             // the last failed verification executed, see LockoutState
+	lockouts                  int                   // the amount of locks triggered since the last successful verification, see LockoutState
+	lockout                   LockoutPolicy         // the policy which decides when the verification is locked
+	hashFunction              crypto.Hash           // the hash function used in the HMAC construction (sha1 - sha156 - sha512)
+	clock                     Clock                 // the source of time, by default the system clock
+	lastAcceptedStep          uint64                // the highest time step counter accepted, tokens of this step or older are replays
+	windowPast                int                   // the amount of steps in the past accepted during the validation
+	windowFuture              int                   // the amount of steps in the future accepted during the validation
+	keyStore                  cryptoengine.KeyStore // the store of the encryption keys, by default the one set via SetKeyStore
+	keyring                   *Keyring              // the cached engines of the encryption keys, it takes precedence over the key store
+	bindingContext            []byte                // the associated data the encrypted bytes are bound to, see WithBindingContext
+	generation                uint64                // incremented by each ToBytes, it tells the newer persisted states from the older ones
+	generationTracker         GenerationTracker     // refuses the persisted states older than the ones already seen, see WithGenerationTracker
+	fixedWindow               bool                  // the window stays on the current step, the drift of the client is not followed, see OutOfBand
+	mutex                     sync.Mutex            // guards the verification state: counter, offset, lockout and last accepted step
 }
 
 // This function is used to synchronize the counter with the client
 // Offset can be a negative number as well
-// Usually it's either -1, 0 or 1
-// This is used internally
+// It's always within the validation window, usually it's either -1, 0 or 1
+// The validation window of the following verifications is centred on it, see windowOffsets
+// This is used internally, with the lock held
 func (otp *Totp) synchronizeCounter(offset int) {
 	otp.clientOffset = offset
 }
 
 // Label returns the combination of issuer:account string
 func (otp *Totp) label() string {
-	return fmt.Sprintf("%s:%s", url.QueryEscape(otp.issuer), otp.account)
+	return formatLabel(otp.issuer, otp.account)
+}
+
+// Returns the combination of issuer:account string used in the otpauth URL
+func formatLabel(issuer, account string) string {
+	return fmt.Sprintf("%s:%s", url.QueryEscape(issuer), account)
 }
 
 // Counter returns the TOTP's 8-byte counter as unsigned 64-bit integer.
@@ -76,11 +106,12 @@ func (otp *Totp) getIntCounter() uint64 {
 // issuer: the name of the company/service
 // hash: is the crypto function used: crypto.SHA1, crypto.SHA256, crypto.SHA512
 // digits: is the token amount of digits (6 or 7 or 8)
-// steps: the amount of second the token is valid
+// options: optional settings, for instance WithClock, WithWindow or WithPeriod (the amount of seconds the token is valid, by default 30)
+// WithCodeFormatter replaces the decimal codes, for instance with the Steam Guard ones, the digits are then ignored
 // it automatically generates a secret key using the golang crypto rand package. If there is not enough entropy the function returns an error
 // The key is not encrypted in this package. It's a secret key. Therefore if you transfer the key bytes in the network,
 // please take care of protecting the key or in fact all the bytes.
-func NewTOTP(account, issuer string, hash crypto.Hash, digits int) (*Totp, error) {
+func NewTOTP(account, issuer string, hash crypto.Hash, digits int, options ...TotpOption) (*Totp, error) {
 
 	keySize := hash.Size()
 	key := make([]byte, keySize)
@@ -94,7 +125,16 @@ func NewTOTP(account, issuer string, hash crypto.Hash, digits int) (*Totp, error
 		digits = 8
 	}
 
-	return makeTOTP(key, account, issuer, hash, digits)
+	otp, err := makeTOTP(key, account, issuer, hash, digits)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyTotpOptions(otp, options); err != nil {
+		return nil, err
+	}
+
+	return otp, nil
 
 }
 
@@ -106,86 +146,225 @@ func makeTOTP(key []byte, account, issuer string, hash crypto.Hash, digits int)
 	otp.account = account
 	otp.issuer = issuer
 	otp.digits = digits
-	otp.stepSize = 30 // we set it to 30 seconds which is the recommended value from the RFC
+	otp.formatter = decimalFormatter(digits)
+	otp.stepSize = step_size // we set it to 30 seconds which is the recommended value from the RFC, it can be changed with the WithPeriod option
 	otp.clientOffset = 0
 	otp.hashFunction = hash
+	otp.clock = systemClock{}
+	otp.windowPast = window_size
+	otp.windowFuture = window_size
+	otp.lockout = defaultLockoutPolicy()
 	return otp, nil
 }
 
+// Returns the current time of the Totp clock
+// If the Totp was not created via the constructor, it falls back to the system clock
+func (otp *Totp) now() time.Time {
+	if otp.clock == nil {
+		return time.Now()
+	}
+	return otp.clock.Now()
+}
+
 // This function validates the user provided token
-// It calculates 3 different tokens. The current one, one before now and one after now.
+// It calculates the tokens of the validation window. By default 3 different tokens: the current one, one before now and one after now.
+// The window can be changed with the WithWindow option.
 // The difference is driven by the TOTP step size
-// Based on which of the 3 steps it succeeds to validates, the client offset is updated.
+// Based on which of the steps it succeeds to validates, the client offset is updated: the window of the following
+// verifications is centred on the step of the device, so that a drifting device keeps being accepted,
+// as long as it stays within 10 steps from the current one.
+// A token is accepted only once: the time step counter of the matched token is remembered and any token
+// of the same or of an older step is rejected with TokenReplayError, which counts as a verification failure.
 // It also updates the total amount of verification failures and the last time a verification happened in UTC time
-// Returns an error in case of verification failure, with the reason
-// There is a very basic method which protects from timing attacks, although if the step time used is low it should not be necessary
-// An attacker can still learn the synchronization offset. This is however irrelevant because the attacker has then 30 seconds to
-// guess the code and after 3 failures the function returns an error for the following 5 minutes
+// Returns an error in case of verification failure, with the reason: ErrEmptyToken, ErrMismatch, TokenReplayError or LockDownError
+// ValidateResult reports, in addition, the details of the verification.
+// The tokens of the whole window are always calculated and compared in constant time, so that the time taken
+// does not reveal whether, and at which position of the window, the token matched.
+// In addition the lockout policy limits the amount of guesses: by default after 3 failures the function returns an error for the following 5 minutes.
+// The policy can be changed with the WithLockoutPolicy option.
 func (otp *Totp) Validate(userCode string) error {
+	return otp.ValidateAt(userCode, otp.now())
+}
+
+// ValidateAt validates the user provided token as if the verification happened at the time t
+// It behaves exactly as Validate, which is ValidateAt with the current time of the Totp clock
+func (otp *Totp) ValidateAt(userCode string, t time.Time) error {
+	_, err := otp.ValidateResultAt(userCode, t)
+	if errors.Is(err, ErrLockedOut) {
+		return LockDownError
+	}
+	return err
+}
+
+// ValidateResult validates the user provided token like Validate, and reports the details of the verification
+// The errors can be checked with errors.Is: ErrEmptyToken, ErrMismatch, TokenReplayError and ErrLockedOut,
+// in which case the error is a *LockedOutError, which tells when the verification can be retried.
+func (otp *Totp) ValidateResult(userCode string) (ValidationResult, error) {
+	return otp.ValidateResultAt(userCode, otp.now())
+}
+
+// ValidateResultAt validates the user provided token as if the verification happened at the time t, see ValidateResult
+func (otp *Totp) ValidateResultAt(userCode string, t time.Time) (ValidationResult, error) {
 
 	// check Totp initialization
 	if err := totpHasBeenInitialized(otp); err != nil {
-		return err
+		return ValidationResult{}, err
 	}
 
 	// verify that the token is valid
 	if userCode == "" {
-		return errors.New("User provided token is empty")
+		return ValidationResult{}, ErrEmptyToken
 	}
 
-	// check against the total amount of failures
-	if otp.totalVerificationFailures >= max_failures && !validBackoffTime(otp.lastVerificationTime) {
-		return LockDownError
+	// the whole verification happens under the lock
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+
+	// check against the lockout policy
+	if isLockedOut(otp.lockoutPolicy(), otp.lockoutState(), t) {
+		result := otp.result(t, 0, false)
+		return result, &LockedOutError{RetryAfter: result.LockedUntil.Sub(t)}
 	}
 
-	if otp.totalVerificationFailures >= max_failures && validBackoffTime(otp.lastVerificationTime) {
-		// reset the total verification failures counter
-		otp.totalVerificationFailures = 0
+	if index, ok := otp.matchToken(userCode, t); ok {
+
+		if err := otp.acceptStep(t, index); err != nil {
+			return otp.result(t, index, true), err
+		}
+
+		// re-synchronize, also when the device is back to the current step
+		if !otp.fixedWindow {
+			otp.synchronizeCounter(index)
+		}
+
+		// the user proved to own the device, the failures are forgotten
+		otp.setLockoutState(LockoutState{})
+		return otp.result(t, index, true), nil
+	}
+
+	otp.fail(t)
+
+	// no token of the window matched
+	return otp.result(t, 0, true), ErrMismatch
+}
+
+// Private function which compares the user provided token with the tokens of the whole validation window, at the time t
+// It returns the step offset of the matching token, the closest to the step of the device if more than one matches.
+// All the tokens are calculated and compared in constant time, without exiting early,
+// so that the time taken does not reveal whether, and at which position of the window, the token matched.
+func (otp *Totp) matchToken(userCode string, t time.Time) (int, bool) {
+	userToken := []byte(userCode)
+	offsets := otp.windowOffsets()
+
+	found, match := 0, 0
+	for i, index := range offsets {
+		equal := subtle.ConstantTimeCompare([]byte(calculateTOTP(otp, t, index)), userToken)
+		// keep the first match, the offsets are ordered by distance from the current step
+		match = subtle.ConstantTimeSelect(equal&^found, i, match)
+		found |= equal
 	}
 
-	// calculate the sha256 of the user code
-	userTokenHash := sha256.Sum256([]byte(userCode))
-	userToken := hex.EncodeToString(userTokenHash[:])
+	return offsets[match], found == 1
+}
+
+// Returns the step offsets of the validation window, ordered by distance from the step of the device
+// The window is centred on the client offset, the steps more than 10 steps away from the current one are left out.
+// example with 2 steps in the past, 1 in the future and the client offset -1: -1, -2, 0, -3
+// It must be called with the lock held
+func (otp *Totp) windowOffsets() []int {
+	centre := otp.clientOffset
+	offsets := []int{centre}
+	for i := 1; i <= otp.windowPast || i <= otp.windowFuture; i++ {
+		if i <= otp.windowPast && centre-i >= -max_window_size {
+			offsets = append(offsets, centre-i)
+		}
+		if i <= otp.windowFuture && centre+i <= max_window_size {
+			offsets = append(offsets, centre+i)
+		}
+	}
+	return offsets
+}
 
-	// 1 calculate the 3 tokens
-	tokens := make([]string, 3)
-	token0Hash := sha256.Sum256([]byte(calculateTOTP(otp, -1)))
-	token1Hash := sha256.Sum256([]byte(calculateTOTP(otp, 0)))
-	token2Hash := sha256.Sum256([]byte(calculateTOTP(otp, 1)))
+// Private function which records the time step of a matched token as used
+// If the step is not newer than the last accepted one, the token is a replay:
+// it's counted as a verification failure and TokenReplayError is returned
+// It must be called with the lock held
+func (otp *Totp) acceptStep(t time.Time, index int) error {
+	step := otp.stepAt(t, index)
+	if step <= otp.lastAcceptedStep {
+		otp.fail(t)
+		return TokenReplayError
+	}
+	otp.lastAcceptedStep = step
+	otp.counter = bigendian.ToUint64(step)
+	return nil
+}
 
-	tokens[0] = hex.EncodeToString(token0Hash[:]) // 30 seconds ago token
-	tokens[1] = hex.EncodeToString(token1Hash[:]) // current token
-	tokens[2] = hex.EncodeToString(token2Hash[:]) // next 30 seconds token
+// Private function which records a verification failure at the time t via the lockout policy
+// It must be called with the lock held
+func (otp *Totp) fail(t time.Time) {
+	otp.setLockoutState(otp.lockoutPolicy().Fail(otp.lockoutState(), t.UTC())) // important to have it in UTC
+}
 
-	// if the current time token is valid then, no need to re-sync and return nil
-	if tokens[1] == userToken {
-		return nil
+// Returns the lockout policy of the Totp
+// If the Totp was not created via the constructor, it falls back to the default policy
+func (otp *Totp) lockoutPolicy() LockoutPolicy {
+	if otp.lockout == nil {
+		return defaultLockoutPolicy()
 	}
+	return otp.lockout
+}
 
-	// if the 30 seconds ago token is valid then return nil, but re-synchronize
-	if tokens[0] == userToken {
-		otp.synchronizeCounter(-1)
-		return nil
+// Returns the lockout state stored in the Totp
+// It must be called with the lock held
+func (otp *Totp) lockoutState() LockoutState {
+	return LockoutState{
+		Failures:    otp.totalVerificationFailures,
+		Lockouts:    otp.lockouts,
+		LastFailure: otp.lastVerificationTime,
 	}
+}
+
+// Stores the lockout state in the Totp
+// It must be called with the lock held
+func (otp *Totp) setLockoutState(state LockoutState) {
+	otp.totalVerificationFailures = state.Failures
+	otp.lockouts = state.Lockouts
+	otp.lastVerificationTime = state.LastFailure
+}
 
-	// if the let's say 30 seconds ago token is valid then return nil, but re-synchronize
-	if tokens[2] == userToken {
-		otp.synchronizeCounter(1)
-		return nil
+// LockedUntil returns the time until which the verification is locked, according to the lockout policy
+// It returns the zero time if the verification is not locked at the current time of the Totp clock
+func (otp *Totp) LockedUntil() time.Time {
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+	if !isLockedOut(otp.lockoutPolicy(), otp.lockoutState(), otp.now()) {
+		return time.Time{}
 	}
+	return otp.lockoutPolicy().LockedUntil(otp.lockoutState())
+}
 
-	otp.totalVerificationFailures++
-	otp.lastVerificationTime = time.Now().UTC() // important to have it in UTC
+// Private function which checks, under the lock, whether the verification is locked at the time t
+func (otp *Totp) lockedAt(t time.Time) bool {
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+	return isLockedOut(otp.lockoutPolicy(), otp.lockoutState(), t)
+}
 
-	// if we got here everything is good
-	return errors.New("Tokens mismatch.")
+// Private function which checks, under the lock, whether the token of the time t has been accepted already
+func (otp *Totp) usedAt(t time.Time) bool {
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+	return otp.stepAt(t, 0) <= otp.lastAcceptedStep
 }
 
-// Checks the time difference between the function call time and the parameter
-// if the difference of time is greater than BACKOFF_MINUTES  it returns true, otherwise false
-func validBackoffTime(lastVerification time.Time) bool {
-	diff := lastVerification.UTC().Add(backoff_minutes * time.Minute)
-	return time.Now().UTC().After(diff)
+// ResetLockout removes the lock and forgets all the verification failures
+// It's meant to be used from an administration path, for instance after the identity of the user has been verified.
+// The Totp needs to be persisted afterwards.
+func (otp *Totp) ResetLockout() {
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+	otp.setLockoutState(LockoutState{})
 }
 
 // Basically, we define TOTP as TOTP = HOTP(K, T), where T is an integer
@@ -196,11 +375,12 @@ func validBackoffTime(lastVerification time.Time) bool {
 // For example, with T0 = 0 and Time Step X = 30, T = 1 if the current
 // Unix time is 59 seconds, and T = 2 if the current Unix time is
 // 60 seconds.
-func (otp *Totp) incrementCounter(index int) {
+// Returns the value of T at the time t, moved by index steps
+func (otp *Totp) stepAt(t time.Time, index int) uint64 {
 	// Unix returns t as a Unix time, the number of seconds elapsed since January 1, 1970 UTC.
 	counterOffset := time.Duration(index*otp.stepSize) * time.Second
-	now := time.Now().UTC().Add(counterOffset).Unix()
-	otp.counter = bigendian.ToUint64(increment(now, otp.stepSize))
+	now := t.UTC().Add(counterOffset).Unix()
+	return increment(now, otp.stepSize)
 }
 
 // Function which calculates the value of T (see rfc6238)
@@ -212,40 +392,91 @@ func increment(ts int64, stepSize int) uint64 {
 
 // Generates a new one time password with hmac-(HASH-FUNCTION)
 func (otp *Totp) OTP() (string, error) {
+	return otp.OTPAt(otp.now())
+}
+
+// OTPAt generates the one time password valid at the time t
+func (otp *Totp) OTPAt(t time.Time) (string, error) {
 
 	// verify the proper initialization
 	if err := totpHasBeenInitialized(otp); err != nil {
 		return "", err
 	}
 
-	// it uses the index 0, meaning that it calculates the current one
-	return calculateTOTP(otp, 0), nil
+	// it uses the index 0, meaning that it calculates the one of the time t
+	return calculateTOTP(otp, t, 0), nil
 }
 
-// Private function which calculates the OTP token based on the index offset
+// Private function which calculates the OTP token based on the time t and the index offset
 // example: 1 * steps or -1 * steps
-func calculateTOTP(otp *Totp, index int) string {
-	var h hash.Hash
+// It depends only on the time, the key and the settings, which never change, therefore it doesn't need the lock
+func calculateTOTP(otp *Totp, t time.Time, index int) string {
+	h := newHMAC(otp.hashFunction, otp.key)
+
+	// the counter of the step based on the time t
+	counter := bigendian.ToUint64(otp.stepAt(t, index))
+
+	return calculateToken(counter[:], otp.codeFormatter(), h)
 
-	switch otp.hashFunction {
+}
+
+// Returns the formatter of the codes
+// If the Totp was not created via the constructor, it falls back to the decimal codes
+func (otp *Totp) codeFormatter() CodeFormatter {
+	if otp.formatter == nil {
+		return decimalFormatter(otp.digits)
+	}
+	return otp.formatter
+}
+
+// Private function which creates the HMAC for the given hash function and key
+// Anything different from SHA256 and SHA512 falls back to SHA1
+func newHMAC(hashFunction crypto.Hash, key []byte) hash.Hash {
+	switch hashFunction {
 	case crypto.SHA256:
-		h = hmac.New(sha256.New, otp.key)
-		break
+		return hmac.New(sha256.New, key)
 	case crypto.SHA512:
-		h = hmac.New(sha512.New, otp.key)
-		break
+		return hmac.New(sha512.New, key)
 	default:
-		h = hmac.New(sha1.New, otp.key)
-		break
-
+		return hmac.New(sha1.New, key)
 	}
+}
 
-	// set the counter to the current step based ont the current time
-	// this is necessary to generate the proper OTP
-	otp.incrementCounter(index)
+// Returns the algorithm name as expected by the otpauth URL format
+func algorithmName(hashFunction crypto.Hash) string {
+	switch hashFunction {
+	case crypto.SHA256:
+		return "SHA256"
+	case crypto.SHA512:
+		return "SHA512"
+	default:
+		return "SHA1"
+	}
+}
 
-	return calculateToken(otp.counter[:], otp.digits, h)
+// Returns the hash function type as stored in the serialized format
+// 0 = SHA1; 1 = SHA256; 2 = SHA512
+func hashFunctionType(hashFunction crypto.Hash) int {
+	switch hashFunction {
+	case crypto.SHA256:
+		return 1
+	case crypto.SHA512:
+		return 2
+	default:
+		return 0
+	}
+}
 
+// Returns the hash function from the type stored in the serialized format
+func hashFunctionFromType(hashType int) crypto.Hash {
+	switch hashType {
+	case 1:
+		return crypto.SHA256
+	case 2:
+		return crypto.SHA512
+	default:
+		return crypto.SHA1
+	}
 }
 
 func truncateHash(hmac_result []byte, size int) int64 {
@@ -258,17 +489,14 @@ func truncateHash(hmac_result []byte, size int) int64 {
 }
 
 // this is the function which calculates the HTOP code
-func calculateToken(counter []byte, digits int, h hash.Hash) string {
+// the formatter maps the truncated value to the code, see CodeFormatter
+func calculateToken(counter []byte, formatter CodeFormatter, h hash.Hash) string {
 
 	h.Write(counter)
 	hashResult := h.Sum(nil)
 	result := truncateHash(hashResult, h.Size())
 
-	mod := int32(result % int64(math.Pow10(digits)))
-
-	fmtStr := fmt.Sprintf("%%0%dd", digits)
-
-	return fmt.Sprintf(fmtStr, mod)
+	return formatter.Format(uint32(result))
 }
 
 // Secret returns the underlying base32 encoded secret.
@@ -279,39 +507,12 @@ func (otp *Totp) Secret() string {
 	return base32.StdEncoding.EncodeToString(otp.key)
 }
 
-// URL returns a suitable URL, such as for the Google Authenticator app
-// example: otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example
+// url returns the Key URI format URL used for the QR code
+// example: otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example&algorithm=SHA1&digits=6&period=30
+// Use the URL method or the URLBuilder to check the compatibility with a specific authenticator app
 func (otp *Totp) url() (string, error) {
-
-	// verify the proper initialization
-	if err := totpHasBeenInitialized(otp); err != nil {
-		return "", err
-	}
-
-	secret := base32.StdEncoding.EncodeToString(otp.key)
-	u := url.URL{}
-	v := url.Values{}
-	u.Scheme = "otpauth"
-	u.Host = "totp"
-	u.Path = otp.label()
-	v.Add("secret", secret)
-	v.Add("counter", fmt.Sprintf("%d", otp.getIntCounter()))
-	v.Add("issuer", otp.issuer)
-	v.Add("digits", strconv.Itoa(otp.digits))
-	v.Add("period", strconv.Itoa(otp.stepSize))
-	switch otp.hashFunction {
-	case crypto.SHA256:
-		v.Add("algorithm", "SHA256")
-		break
-	case crypto.SHA512:
-		v.Add("algorithm", "SHA512")
-		break
-	default:
-		v.Add("algorithm", "SHA1")
-		break
-	}
-	u.RawQuery = v.Encode()
-	return u.String(), nil
+	u, _, err := URLBuilder{Profile: KeyURIProfile}.Build(otp)
+	return u, err
 }
 
 // QR generates a byte array containing QR code encoded PNG image, with level Q error correction,
@@ -337,21 +538,129 @@ func (otp *Totp) QR() ([]byte, error) {
 }
 
 // ToBytes serialises a TOTP object in a byte array
-// Sizes:         4        4      N     8       4        4        N         4          N      4     4          4               8                 4
-// Format: |total_bytes|key_size|key|counter|digits|issuer_size|issuer|account_size|account|steps|offset|total_failures|verification_time|hashFunction_type|
+// The data starts with the format header, see format.go:
+// Sizes:     4       4
+// Format: |marker|version|
+// followed by the fields of the current format version:
+// Sizes:         4        4      N     8       4        4        N         4          N      4     4          4               8                 4                  8                4            4
+// Format: |total_bytes|key_size|key|counter|digits|issuer_size|issuer|account_size|account|steps|offset|total_failures|verification_time|hashFunction_type|last_accepted_step|window_past|window_future|
 // hashFunction_type: 0 = SHA1; 1 = SHA256; 2 = SHA512
+// The lockout policy and the amount of locks are stored at the end:
+// Sizes:       4                 4                 8                8           4
+// Format: |lockout_type|lockout_max_failures|lockout_backoff|lockout_max_backoff|lockouts|
+// lockout_type: 0 = flat; 1 = exponential; 2 = permanent; 255 = custom (see WithLockoutPolicy)
+// lockout_backoff, lockout_max_backoff: in seconds
+// The code formatter is stored last, its length is the digits field:
+// Sizes:      4           4             N
+// Format: |code_type|alphabet_size|alphabet|
+// code_type: 0 = decimal; 1 = alphabet; 255 = custom (see WithCodeFormatter)
+// followed by the generation of the state, incremented by each call (see GenerationTracker):
+// Sizes:      8
+// Format: |generation|
+// The data serialized by the earlier versions is still parsed, see MigrateTOTP
 // The data is encrypted using the cryptoengine library (which is a wrapper around the golang NaCl library)
 // TODO:
 // 1- improve sizes. For instance the hashFunction_type could be a short.
 func (otp *Totp) ToBytes() ([]byte, error) {
 
+	// check Totp initialization, before looking for its keyring
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return nil, err
+	}
+
+	return otp.ToBytesWith(otp.currentKeyring())
+}
+
+// ToBytesWith serialises the TOTP object like ToBytes, with the crypto engine of the issuer held by the keyring
+// It avoids loading the keys from the key store at each call, see Keyring.
+func (otp *Totp) ToBytesWith(keyring *Keyring) ([]byte, error) {
+
+	if keyring == nil {
+		return nil, keyringError
+	}
+
+	// check Totp initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return nil, err
+	}
+
+	data, _, err := otp.encrypt(keyring, otp.bindingContext, otp.generationTracker)
+	return data, err
+}
+
+// ToBytesWithContext serialises the TOTP object like ToBytes, with the encryption bound to the context,
+// for instance NewBindingContext("users", accountID): the bytes can be decrypted only by TOTPFromBytesWithContext with the same context.
+// The context is authenticated, but neither encrypted nor stored: copying the bytes of an account to the row of another account
+// makes the decryption fail, as long as the context identifies the row.
+func (otp *Totp) ToBytesWithContext(context []byte) ([]byte, error) {
+
+	if len(context) == 0 {
+		return nil, bindingContextError
+	}
+
 	// check Totp initialization
 	if err := totpHasBeenInitialized(otp); err != nil {
 		return nil, err
 	}
 
+	data, _, err := otp.encrypt(otp.currentKeyring(), context, otp.generationTracker)
+	return data, err
+}
+
+// Private function which serializes and encrypts the TOTP object, bound to the context if it's not empty
+// Each call persists a new generation of the state, which is returned along with the bytes
+// and recorded right away in the tracker, if any.
+func (otp *Totp) encrypt(keyring *Keyring, context []byte, tracker GenerationTracker) ([]byte, uint64, error) {
+
+	data, generation, err := otp.serializeNextGeneration()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// encrypt the TOTP bytes
+	encrypted, err := encryptBytes(keyring, otp.issuer, string(data), message_type, context)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if tracker != nil {
+		if err := tracker.Observe(otp.label(), generation); err != nil {
+			return nil, 0, err
+		}
+	}
+	return encrypted, generation, nil
+}
+
+// Private function which serializes the TOTP object in clear text, in the format described in ToBytes
+func (otp *Totp) serialize() ([]byte, error) {
+
+	// the state is read under the lock
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+
+	return otp.serializeState()
+}
+
+// Private function which increments the generation and serializes the TOTP object, in one step under the lock,
+// so that the concurrent calls never serialize the same generation
+func (otp *Totp) serializeNextGeneration() ([]byte, uint64, error) {
+	otp.mutex.Lock()
+	defer otp.mutex.Unlock()
+
+	otp.generation++
+	data, err := otp.serializeState()
+	return data, otp.generation, err
+}
+
+// Private function which serializes the TOTP object in clear text
+// This is used internally, with the lock held
+func (otp *Totp) serializeState() ([]byte, error) {
+
 	var buffer bytes.Buffer
 
+	// format header
+	writeFormatHeader(&buffer, totp_format_version)
+
 	// calculate the length of the key and create its byte representation
 	keySize := len(otp.key)
 	keySizeBytes := bigendian.ToInt(keySize) //bigEndianInt(keySize)
@@ -364,7 +673,11 @@ func (otp *Totp) ToBytes() ([]byte, error) {
 	accountSize := len(otp.account)
 	accountSizeBytes := bigendian.ToInt(accountSize)
 
-	totalSize := 4 + 4 + keySize + 8 + 4 + 4 + issuerSize + 4 + accountSize + 4 + 4 + 4 + 8 + 4
+	// the code formatter and the length of its alphabet
+	codeType, alphabet := codeFormatterToValues(otp.codeFormatter())
+	alphabetSize := len(alphabet)
+
+	totalSize := 4 + 4 + keySize + 8 + 4 + 4 + issuerSize + 4 + accountSize + 4 + 4 + 4 + 8 + 4 + 8 + 4 + 4 + 4 + 4 + 8 + 8 + 4 + 4 + 4 + alphabetSize + 8
 	totalSizeBytes := bigendian.ToInt(totalSize)
 
 	// at this point we are ready to write the data to the byte buffer
@@ -434,174 +747,183 @@ func (otp *Totp) ToBytes() ([]byte, error) {
 	}
 
 	// has_function_type
-	switch otp.hashFunction {
-	case crypto.SHA256:
-		sha256Bytes := bigendian.ToInt(1)
-		if _, err := buffer.Write(sha256Bytes[:]); err != nil {
-			return nil, err
-		}
-		break
-	case crypto.SHA512:
-		sha512Bytes := bigendian.ToInt(2)
-		if _, err := buffer.Write(sha512Bytes[:]); err != nil {
-			return nil, err
-		}
-		break
-	default:
-		sha1Bytes := bigendian.ToInt(0)
-		if _, err := buffer.Write(sha1Bytes[:]); err != nil {
-			return nil, err
-		}
+	hashTypeBytes := bigendian.ToInt(hashFunctionType(otp.hashFunction))
+	if _, err := buffer.Write(hashTypeBytes[:]); err != nil {
+		return nil, err
 	}
 
-	// encrypt the TOTP bytes
-	engine, err := cryptoengine.InitCryptoEngine(otp.issuer)
+	// last accepted step
+	lastAcceptedStepBytes := bigendian.ToUint64(otp.lastAcceptedStep)
+	if _, err := buffer.Write(lastAcceptedStepBytes[:]); err != nil {
+		return nil, err
+	}
+
+	// validation window
+	windowPastBytes := bigendian.ToInt(otp.windowPast)
+	if _, err := buffer.Write(windowPastBytes[:]); err != nil {
+		return nil, err
+	}
+	windowFutureBytes := bigendian.ToInt(otp.windowFuture)
+	if _, err := buffer.Write(windowFutureBytes[:]); err != nil {
+		return nil, err
+	}
+
+	// lockout policy and state
+	policyType, policyMaxFailures, policyBackoff, policyMaxBackoff := lockoutPolicyToValues(otp.lockoutPolicy())
+	policyTypeBytes := bigendian.ToInt(policyType)
+	if _, err := buffer.Write(policyTypeBytes[:]); err != nil {
+		return nil, err
+	}
+	policyMaxFailuresBytes := bigendian.ToInt(policyMaxFailures)
+	if _, err := buffer.Write(policyMaxFailuresBytes[:]); err != nil {
+		return nil, err
+	}
+	policyBackoffBytes := bigendian.ToUint64(uint64(policyBackoff))
+	if _, err := buffer.Write(policyBackoffBytes[:]); err != nil {
+		return nil, err
+	}
+	policyMaxBackoffBytes := bigendian.ToUint64(uint64(policyMaxBackoff))
+	if _, err := buffer.Write(policyMaxBackoffBytes[:]); err != nil {
+		return nil, err
+	}
+	lockoutsBytes := bigendian.ToInt(otp.lockouts)
+	if _, err := buffer.Write(lockoutsBytes[:]); err != nil {
+		return nil, err
+	}
+
+	// code formatter
+	codeTypeBytes := bigendian.ToInt(codeType)
+	if _, err := buffer.Write(codeTypeBytes[:]); err != nil {
+		return nil, err
+	}
+	alphabetSizeBytes := bigendian.ToInt(alphabetSize)
+	if _, err := buffer.Write(alphabetSizeBytes[:]); err != nil {
+		return nil, err
+	}
+	if _, err := buffer.WriteString(alphabet); err != nil {
+		return nil, err
+	}
+
+	// generation
+	generationBytes := bigendian.ToUint64(otp.generation)
+	if _, err := buffer.Write(generationBytes[:]); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Private function which encrypts the serialized data with the cryptoengine of the issuer, held by the keyring
+// messageType distinguishes the different serialized objects (TOTP, HOTP)
+// associatedData: the binding context, nil if the bytes are not bound to anything
+func encryptBytes(keyring *Keyring, issuer, data string, messageType int, associatedData []byte) ([]byte, error) {
+
+	engine, err := keyring.engine(issuer)
 	if err != nil {
 		return nil, err
 	}
 
 	// init the message to be encrypted
-	message, err := cryptoengine.NewMessage(buffer.String(), message_type)
+	message, err := cryptoengine.NewMessage(data, messageType)
 	if err != nil {
 		return nil, err
 	}
 
 	// encrypt it
-	encryptedMessage, err := engine.NewEncryptedMessage(message)
+	encryptedMessage, err := engine.NewEncryptedMessageWithAssociatedData(message, associatedData)
 	if err != nil {
 		return nil, err
 	}
 
 	return encryptedMessage.ToBytes()
+}
+
+// Private function which decrypts the serialized data with the cryptoengine of the issuer, held by the keyring
+// It returns an error if the decrypted message is not of the expected messageType
+// If the key of the message is missing, it may have been created by a rotation done elsewhere: the engine is reloaded once.
+// associatedData: the binding context of encryptBytes, the decryption fails if it differs
+func decryptBytes(keyring *Keyring, issuer string, encryptedMessage []byte, messageType int, associatedData []byte) ([]byte, error) {
+
+	// the cached cryptoengine
+	engine, err := keyring.engine(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// decrypt the message
+	data, err := engine.DecryptWithAssociatedData(encryptedMessage, associatedData)
+	if err == cryptoengine.KeyNotFoundError {
+		keyring.Reload(issuer)
+		if engine, err = keyring.engine(issuer); err != nil {
+			return nil, err
+		}
+		data, err = engine.DecryptWithAssociatedData(encryptedMessage, associatedData)
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	if data.Type != messageType {
+		return nil, messageTypeError
+	}
+
+	return []byte(data.Text), nil
 }
 
 // TOTPFromBytes converts a byte array to a totp object
 // it stores the state of the TOTP object, like the key, the current counter, the client offset,
 // the total amount of verification failures and the last time a verification happened
-func TOTPFromBytes(encryptedMessage []byte, issuer string) (*Totp, error) {
+// The options, for instance WithClock, are applied after the state has been restored
+// The corrupted data returns a *DecodeError, which tells the field and the kind of corruption
+// The codes of a custom CodeFormatter need the formatter to be passed again, otherwise CodeFormatterMissingError is returned
+// A custom LockoutPolicy needs to be passed again as well, otherwise LockoutPolicyMissingError is returned
+func TOTPFromBytes(encryptedMessage []byte, issuer string, options ...TotpOption) (*Totp, error) {
 
-	// init the cryptoengine
-	engine, err := cryptoengine.InitCryptoEngine(issuer)
+	settings, err := settingsFromOptions(options)
 	if err != nil {
 		return nil, err
 	}
 
 	// decrypt the message
-	data, err := engine.Decrypt(encryptedMessage)
+	data, err := decryptBytes(settings.currentKeyring(), issuer, encryptedMessage, message_type, settings.bindingContext)
 	if err != nil {
 		return nil, err
 	}
 
-	// new reader
-	reader := bytes.NewReader([]byte(data.Text))
-
-	// otp object
-	otp := new(Totp)
+	otp, err := deserializeTOTP(data)
+	if err != nil {
+		return nil, err
+	}
 
-	// get the length
-	length := make([]byte, 4)
-	_, err = reader.Read(length) // read the 4 bytes for the total length
-	if err != nil && err != io.EOF {
-		return otp, err
-	}
-
-	totalSize := bigendian.FromInt([4]byte{length[0], length[1], length[2], length[3]})
-	buffer := make([]byte, totalSize-4)
-	_, err = reader.Read(buffer)
-	if err != nil && err != io.EOF {
-		return otp, err
-	}
-
-	// skip the total bytes size
-	startOffset := 0
-	// read key size
-	endOffset := startOffset + 4
-	keyBytes := buffer[startOffset:endOffset]
-	keySize := bigendian.FromInt([4]byte{keyBytes[0], keyBytes[1], keyBytes[2], keyBytes[3]})
-
-	// read the key
-	startOffset = endOffset
-	endOffset = startOffset + keySize
-	otp.key = buffer[startOffset:endOffset]
-
-	// read the counter
-	startOffset = endOffset
-	endOffset = startOffset + 8
-	b := buffer[startOffset:endOffset]
-	otp.counter = [8]byte{b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7]}
-
-	// read the digits
-	startOffset = endOffset
-	endOffset = startOffset + 4
-	b = buffer[startOffset:endOffset]
-	otp.digits = bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]}) //
-
-	// read the issuer size
-	startOffset = endOffset
-	endOffset = startOffset + 4
-	b = buffer[startOffset:endOffset]
-	issuerSize := bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
-
-	// read the issuer string
-	startOffset = endOffset
-	endOffset = startOffset + issuerSize
-	otp.issuer = string(buffer[startOffset:endOffset])
-
-	// read the account size
-	startOffset = endOffset
-	endOffset = startOffset + 4
-	b = buffer[startOffset:endOffset]
-	accountSize := bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
-
-	// read the account string
-	startOffset = endOffset
-	endOffset = startOffset + accountSize
-	otp.account = string(buffer[startOffset:endOffset])
-
-	// read the steps
-	startOffset = endOffset
-	endOffset = startOffset + 4
-	b = buffer[startOffset:endOffset]
-	otp.stepSize = bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
-
-	// read the offset
-	startOffset = endOffset
-	endOffset = startOffset + 4
-	b = buffer[startOffset:endOffset]
-	otp.clientOffset = bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
-
-	// read the total failures
-	startOffset = endOffset
-	endOffset = startOffset + 4
-	b = buffer[startOffset:endOffset]
-	otp.totalVerificationFailures = bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
-
-	// read the offset
-	startOffset = endOffset
-	endOffset = startOffset + 8
-	b = buffer[startOffset:endOffset]
-	ts := bigendian.FromUint64([8]byte{b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7]})
-	otp.lastVerificationTime = time.Unix(int64(ts), 0)
-
-	// read the hash type
-	startOffset = endOffset
-	endOffset = startOffset + 4
-	b = buffer[startOffset:endOffset]
-	hashType := bigendian.FromInt([4]byte{b[0], b[1], b[2], b[3]})
+	if err := applyTotpOptions(otp, options); err != nil {
+		return nil, err
+	}
+	if err := otp.checkCodeFormatter(); err != nil {
+		return nil, err
+	}
+	if err := otp.checkLockoutPolicy(); err != nil {
+		return nil, err
+	}
 
-	switch hashType {
-	case 1:
-		otp.hashFunction = crypto.SHA256
-		break
-	case 2:
-		otp.hashFunction = crypto.SHA512
-		break
-	default:
-		otp.hashFunction = crypto.SHA1
+	// refuse the older states
+	if err := otp.observeGeneration(); err != nil {
+		return nil, err
 	}
 
-	return otp, err
+	return otp, nil
+}
+
+// TOTPFromBytesWith converts a byte array to a totp object like TOTPFromBytes, with the crypto engine of the issuer held by the keyring
+// The keyring is set on the totp as well, so that its ToBytes uses it.
+func TOTPFromBytesWith(encryptedMessage []byte, issuer string, keyring *Keyring, options ...TotpOption) (*Totp, error) {
+	return TOTPFromBytes(encryptedMessage, issuer, append([]TotpOption{WithKeyring(keyring)}, options...)...)
+}
+
+// TOTPFromBytesWithContext converts a byte array created by ToBytesWithContext to a totp object, like TOTPFromBytes
+// It fails if the context differs from the one used by ToBytesWithContext.
+// The context is set on the totp as well, so that its ToBytes binds the bytes to the same context.
+func TOTPFromBytesWithContext(encryptedMessage []byte, issuer string, context []byte, options ...TotpOption) (*Totp, error) {
+	return TOTPFromBytes(encryptedMessage, issuer, append([]TotpOption{WithBindingContext(context)}, options...)...)
 }
 
 // this method checks the proper initialization of the Totp object
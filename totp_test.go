@@ -7,9 +7,10 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"encoding/base64"
 	"encoding/hex"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -85,7 +86,7 @@ func TestTOTP(t *testing.T) {
 		counter := increment(ts, 30)
 		otp.counter = bigendian.ToUint64(counter)
 		hash := hmac.New(sha1.New, otp.key)
-		token := calculateToken(otp.counter[:], otp.digits, hash)
+		token := calculateToken(otp.counter[:], otp.codeFormatter(), hash)
 		expected := sha1TestData[index]
 		if token != expected {
 			t.Errorf("SHA1 test data, token mismatch. Got %s, expected %s\n", token, expected)
@@ -98,7 +99,7 @@ func TestTOTP(t *testing.T) {
 		counter := increment(ts, 30)
 		otp.counter = bigendian.ToUint64(counter)
 		hash := hmac.New(sha256.New, otp.key)
-		token := calculateToken(otp.counter[:], otp.digits, hash)
+		token := calculateToken(otp.counter[:], otp.codeFormatter(), hash)
 		expected := sha256TestData[index]
 		if token != expected {
 			t.Errorf("SHA256 test data, token mismatch. Got %s, expected %s\n", token, expected)
@@ -111,7 +112,7 @@ func TestTOTP(t *testing.T) {
 		counter := increment(ts, 30)
 		otp.counter = bigendian.ToUint64(counter)
 		hash := hmac.New(sha512.New, otp.key)
-		token := calculateToken(otp.counter[:], otp.digits, hash)
+		token := calculateToken(otp.counter[:], otp.codeFormatter(), hash)
 		expected := sha512TestData[index]
 		if token != expected {
 			t.Errorf("SHA512 test data, token mismatch. Got %s, expected %s\n", token, expected)
@@ -157,9 +158,9 @@ func TestVerificationFailures(t *testing.T) {
 		}
 	}
 
-	// test the validBackoffTime function
-	if validBackoffTime(otp.lastVerificationTime) {
-		t.Error("validBackoffTime should return false")
+	// test the LockedUntil function
+	if otp.LockedUntil().IsZero() {
+		t.Error("LockedUntil should return the lock expiry")
 	}
 
 	// serialize and deserialize the object and verify again
@@ -178,9 +179,9 @@ func TestVerificationFailures(t *testing.T) {
 		t.Error("Label mismatch between in memory OTP and byte parsed OTP")
 	}
 
-	// test the validBackoffTime function
-	if validBackoffTime(restoredOtp.lastVerificationTime) {
-		t.Error("validBackoffTime should return false")
+	// test the LockedUntil function
+	if restoredOtp.LockedUntil().IsZero() {
+		t.Error("LockedUntil should return the lock expiry")
 	}
 
 	// set the lastVerificationTime back in the past.
@@ -188,22 +189,20 @@ func TestVerificationFailures(t *testing.T) {
 	back10Minutes := time.Duration(-10) * time.Minute
 	otp.lastVerificationTime = time.Now().UTC().Add(back10Minutes)
 
-	// test the validBackoffTime function
-	if !validBackoffTime(otp.lastVerificationTime) {
-		t.Error("validBackoffTime should return true")
+	// test the LockedUntil function
+	if !otp.LockedUntil().IsZero() {
+		t.Error("LockedUntil should return the zero time")
 	}
 
-	for i := 0; i < 10; i++ {
-		if err := otp.Validate(expectedToken); err != nil {
-			t.Fatal(err)
-		}
+	// the expected token has already been used, therefore the next step token is used
+	nextToken := calculateTOTP(otp, time.Now(), 1)
+	if err := otp.Validate(nextToken); err != nil {
+		t.Fatal(err)
+	}
 
-		if i == 0 {
-			// at this point the max failure counter should have been reset to zero
-			if otp.totalVerificationFailures != 0 {
-				t.Errorf("totalVerificationFailures counter not reset to zero. We've got: %d\n", otp.totalVerificationFailures)
-			}
-		}
+	// at this point the max failure counter should have been reset to zero
+	if otp.totalVerificationFailures != 0 {
+		t.Errorf("totalVerificationFailures counter not reset to zero. We've got: %d\n", otp.totalVerificationFailures)
 	}
 
 }
@@ -325,8 +324,22 @@ func TestSerialization(t *testing.T) {
 		t.Error("Deserialized Label property differ from original TOTP")
 	}
 
-	if base64.StdEncoding.EncodeToString(otpData) != base64.StdEncoding.EncodeToString(deserializedOTPData) {
-		t.Error("Problems encoding TOTP to base64")
+	// the deserialized otp has been serialized once more, therefore its generation is the next one
+	if deserializedOTP.Generation() != otp.Generation()+1 {
+		t.Errorf("Expected the generation %d, instead we've got %d\n", otp.Generation()+1, deserializedOTP.Generation())
+	}
+
+	// the clear text is the same but the generation, the last 8 bytes, the encrypted bytes are not, because the nonce is random
+	// the encrypted bytes start with |length 8|key id 4|nonce 24|
+	otpClearText, err := otp.serialize()
+	checkError(t, err)
+	deserializedClearText, err := deserializedOTP.serialize()
+	checkError(t, err)
+	if !bytes.Equal(otpClearText[:len(otpClearText)-8], deserializedClearText[:len(deserializedClearText)-8]) {
+		t.Error("Problems serializing the deserialized TOTP")
+	}
+	if bytes.Equal(otpData[12:12+24], deserializedOTPData[12:12+24]) {
+		t.Error("The same nonce has been used twice")
 	}
 
 	label, err := url.QueryUnescape(otp.label())
@@ -355,38 +368,37 @@ func TestCounterSynchronization(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	token0 := calculateTOTP(otp, 0)
+	now := time.Now()
+
+	token0 := calculateTOTP(otp, now, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	token_1 := calculateTOTP(otp, -1)
+	token_1 := calculateTOTP(otp, now, -1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	token1 := calculateTOTP(otp, 1)
+	token1 := calculateTOTP(otp, now, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = otp.Validate(token0)
+	// the tokens are validated from the oldest, because a token older than an accepted one is a replay
+	err = otp.Validate(token_1)
 	if err != nil {
 		t.Error(err)
 	}
 	// check the values
-	if otp.clientOffset != 0 {
-		t.Errorf("Client offset should be 0, instead we've got %d\n", otp.clientOffset)
+	if otp.clientOffset != -1 {
+		t.Errorf("Client offset should be -1, instead we've got %d\n", otp.clientOffset)
 	}
 
-	err = otp.Validate(token_1)
+	err = otp.Validate(token0)
 	if err != nil {
 		t.Error(err)
 	}
-	// check the values
-	if otp.clientOffset != -1 {
-		t.Errorf("Client offset should be -1, instead we've got %d\n", otp.clientOffset)
-	}
 
 	err = otp.Validate(token1)
 	if err != nil {
@@ -398,3 +410,275 @@ func TestCounterSynchronization(t *testing.T) {
 	}
 
 }
+
+func TestReplayProtection(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock))
+	checkError(t, err)
+
+	token, err := otp.OTP()
+	checkError(t, err)
+	previous := calculateTOTP(otp, clock.Now(), -1)
+
+	if err := otp.Validate(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same token is rejected within the same step
+	if err := otp.Validate(token); err != TokenReplayError {
+		t.Errorf("Expected the token replay error, instead we've got %v\n", err)
+	}
+
+	// a token of an older step is rejected as well
+	if err := otp.Validate(previous); err != TokenReplayError {
+		t.Errorf("Expected the token replay error, instead we've got %v\n", err)
+	}
+
+	if otp.totalVerificationFailures != 2 {
+		t.Errorf("Expected 2 verification failures, instead we've got %d\n", otp.totalVerificationFailures)
+	}
+
+	// the replay protection survives the serialization
+	data, err := otp.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, otp.issuer, WithClock(clock))
+	checkError(t, err)
+	if restored.lastAcceptedStep != otp.lastAcceptedStep {
+		t.Error("Deserialized lastAcceptedStep property differ from original TOTP")
+	}
+
+	// the token of the next step is accepted
+	clock.Advance(30 * time.Second)
+	next, err := restored.OTP()
+	checkError(t, err)
+	if err := restored.Validate(next); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the replay counts towards the lock down
+	if err := restored.Validate(token); err != TokenReplayError {
+		t.Errorf("Expected the token replay error after deserialization, instead we've got %v\n", err)
+	}
+	if restored.totalVerificationFailures != 1 {
+		t.Errorf("Expected 1 verification failure, instead we've got %d\n", restored.totalVerificationFailures)
+	}
+
+}
+
+func TestValidationWindow(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+
+	// strict validation: only the current step is accepted
+	strict, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithWindow(0, 0))
+	checkError(t, err)
+	if err := strict.Validate(calculateTOTP(strict, clock.Now(), -1)); err == nil {
+		t.Error("The previous step token has been accepted with an empty window")
+	}
+	if err := strict.Validate(calculateTOTP(strict, clock.Now(), 1)); err == nil {
+		t.Error("The next step token has been accepted with an empty window")
+	}
+	if err := strict.Validate(calculateTOTP(strict, clock.Now(), 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the empty window follows the device: once a drift has been followed, only the step of the device is accepted
+	strict.synchronizeCounter(-2)
+	next := clock.Now().Add(time.Duration(strict.stepSize) * time.Second)
+	if err := strict.ValidateAt(calculateTOTP(strict, next, 0), next); err == nil {
+		t.Error("The current step token has been accepted with an empty window on a drifting device")
+	}
+	if err := strict.ValidateAt(calculateTOTP(strict, next, -2), next); err == nil {
+		t.Error("The token of an already used step has been accepted")
+	}
+	next = next.Add(2 * time.Duration(strict.stepSize) * time.Second)
+	if err := strict.ValidateAt(calculateTOTP(strict, next, -2), next); err != nil {
+		t.Fatal(err)
+	}
+
+	// drifting devices: 3 steps in the past and 2 in the future
+	drift, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithWindow(3, 2))
+	checkError(t, err)
+	if err := drift.Validate(calculateTOTP(drift, clock.Now(), -4)); err == nil {
+		t.Error("A token outside of the past window has been accepted")
+	}
+	if err := drift.Validate(calculateTOTP(drift, clock.Now(), -3)); err != nil {
+		t.Fatal(err)
+	}
+	if drift.clientOffset != -3 {
+		t.Errorf("Client offset should be -3, instead we've got %d\n", drift.clientOffset)
+	}
+
+	// the window and the negative offset survive the serialization
+	data, err := drift.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, drift.issuer, WithClock(clock))
+	checkError(t, err)
+	if restored.windowPast != 3 || restored.windowFuture != 2 {
+		t.Errorf("Deserialized window differ from original TOTP: %d %d\n", restored.windowPast, restored.windowFuture)
+	}
+	if restored.clientOffset != -3 {
+		t.Errorf("Deserialized clientOffset property differ from original TOTP: %d\n", restored.clientOffset)
+	}
+
+	// the window is centred on the device: 2 steps in the future of the offset -3
+	if err := restored.Validate(calculateTOTP(restored, clock.Now(), 0)); err == nil {
+		t.Error("A token outside of the future window of the device has been accepted")
+	}
+	if err := restored.Validate(calculateTOTP(restored, clock.Now(), -1)); err != nil {
+		t.Fatal(err)
+	}
+	if restored.clientOffset != -1 {
+		t.Errorf("Client offset should be -1, instead we've got %d\n", restored.clientOffset)
+	}
+
+	// a slow device which keeps drifting is followed, one step at a time: it's one step behind every other step
+	slow, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithWindow(1, 1))
+	checkError(t, err)
+	now := clock.Now()
+	for drift := 1; drift <= 3; drift++ {
+		now = now.Add(2 * time.Duration(slow.stepSize) * time.Second)
+		if err := slow.ValidateAt(calculateTOTP(slow, now, -drift), now); err != nil {
+			t.Fatalf("The device %d steps behind has been refused: %v\n", drift, err)
+		}
+	}
+	if slow.clientOffset != -3 {
+		t.Errorf("Client offset should be -3, instead we've got %d\n", slow.clientOffset)
+	}
+
+	// the window never goes beyond 10 steps from the current one
+	far, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithWindow(2, 2))
+	checkError(t, err)
+	far.clientOffset = -max_window_size
+	if offsets := far.windowOffsets(); !reflect.DeepEqual(offsets, []int{-10, -9, -8}) {
+		t.Errorf("Unexpected window offsets %v\n", offsets)
+	}
+
+	// invalid windows are rejected
+	if _, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithWindow(-1, 1)); err == nil {
+		t.Error("A negative window has been accepted")
+	}
+	if _, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithWindow(1, max_window_size+1)); err == nil {
+		t.Error("A too big window has been accepted")
+	}
+
+}
+
+func TestPeriod(t *testing.T) {
+
+	key, err := hex.DecodeString(sha1KeyHex)
+	checkError(t, err)
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+
+	// the 60 seconds token is the 30 seconds one of the halved counter
+	otp, err := makeTOTP(key, "info@sec51.com", "Sec51", crypto.SHA1, 8)
+	checkError(t, err)
+	checkError(t, applyTotpOptions(otp, []TotpOption{WithClock(clock), WithPeriod(60)}))
+
+	token, err := otp.OTP()
+	checkError(t, err)
+	counter := bigendian.ToUint64(uint64(1234567890 / 60))
+	expected := calculateToken(counter[:], decimalFormatter(8), hmac.New(sha1.New, key))
+	if token != expected {
+		t.Errorf("60 seconds period token mismatch. Got %s, expected %s\n", token, expected)
+	}
+
+	// the token is the same during the whole period
+	sameStep, err := otp.OTPAt(time.Unix(1234567890/60*60+59, 0))
+	checkError(t, err)
+	if sameStep != token {
+		t.Error("The token changed within the same period")
+	}
+
+	// the previous period is re-synchronized
+	if err := otp.Validate(calculateTOTP(otp, clock.Now().Add(-60*time.Second), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if otp.clientOffset != -1 {
+		t.Errorf("Client offset should be -1, instead we've got %d\n", otp.clientOffset)
+	}
+
+	u, err := otp.url()
+	checkError(t, err)
+	if !strings.Contains(u, "period=60") {
+		t.Errorf("The URL does not contain the period: %s\n", u)
+	}
+
+	// 10 seconds period
+	short, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 6, WithClock(clock), WithPeriod(10))
+	checkError(t, err)
+	data, err := short.ToBytes()
+	checkError(t, err)
+	restored, err := TOTPFromBytes(data, short.issuer, WithClock(clock))
+	checkError(t, err)
+	if restored.stepSize != 10 {
+		t.Errorf("Deserialized stepSize property differ from original TOTP: %d\n", restored.stepSize)
+	}
+	token, err = restored.OTP()
+	checkError(t, err)
+	if err := short.ValidateAt(token, clock.Now().Add(20*time.Second)); err == nil {
+		t.Error("A token two periods old has been accepted")
+	}
+
+	// invalid periods are rejected
+	for _, period := range []int{0, -30, min_step_size - 1, max_step_size + 1} {
+		if _, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithPeriod(period)); err == nil {
+			t.Errorf("The period %d has been accepted\n", period)
+		}
+	}
+
+}
+
+func TestMatchToken(t *testing.T) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithWindow(3, 2))
+	checkError(t, err)
+
+	for _, offset := range otp.windowOffsets() {
+		token := calculateTOTP(otp, clock.Now(), offset)
+		if matched, ok := otp.matchToken(token, clock.Now()); !ok || matched != offset {
+			t.Errorf("Expected the offset %d to match, instead we've got %d - %v\n", offset, matched, ok)
+		}
+	}
+
+	for _, token := range []string{"", "0", "123456789", calculateTOTP(otp, clock.Now(), 3)} {
+		if _, ok := otp.matchToken(token, clock.Now()); ok {
+			t.Errorf("The token %q outside of the window has matched\n", token)
+		}
+	}
+
+}
+
+// BenchmarkMatchToken shows that the time taken to validate a token does not depend
+// on the position of the matching token in the window, nor on whether it matches at all
+func BenchmarkMatchToken(b *testing.B) {
+
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA1, 8, WithClock(clock), WithWindow(max_window_size, max_window_size))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+	}{
+		{"current", calculateTOTP(otp, clock.Now(), 0)},
+		{"past", calculateTOTP(otp, clock.Now(), -max_window_size/2)},
+		{"oldest", calculateTOTP(otp, clock.Now(), -max_window_size)},
+		{"newest", calculateTOTP(otp, clock.Now(), max_window_size)},
+		{"mismatch", calculateTOTP(otp, clock.Now(), max_window_size+1)},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				otp.matchToken(c.token, clock.Now())
+			}
+		})
+	}
+
+}
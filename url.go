@@ -0,0 +1,365 @@
+package twofactor
+
+import (
+	"crypto"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URLProfile identifies the authenticator app an otpauth URL is built for
+// Each app supports a different subset of the Key URI format parameters
+type URLProfile int
+
+const (
+	KeyURIProfile                 URLProfile = iota // the Key URI format specification, as strict as possible
+	GoogleAuthenticatorProfile                      // Google Authenticator: SHA1, 6 digits and 30 seconds only, the other values are silently ignored
+	MicrosoftAuthenticatorProfile                   // Microsoft Authenticator: SHA1, 6 digits and 30 seconds only
+	FreeOTPProfile                                  // FreeOTP: SHA1, SHA256, SHA512, 6 or 8 digits, any period and the image parameter
+)
+
+var (
+	URLParsingError        = errors.New("The otpauth URL is malformed")
+	URLSchemeError         = errors.New("The URL scheme must be otpauth")
+	URLTypeError           = errors.New("The otpauth URL type is not supported, it must be totp")
+	URLLabelError          = errors.New("The otpauth URL label must contain the account name")
+	URLSecretError         = errors.New("The otpauth URL secret is missing or it's not a valid base32 string")
+	URLAlgorithmError      = errors.New("The otpauth URL algorithm is not supported, it must be SHA1, SHA256 or SHA512")
+	URLDigitsError         = errors.New("The otpauth URL digits must be 6, 7 or 8")
+	URLPeriodError         = errors.New("The otpauth URL period is not a valid number of seconds")
+	URLEncoderError        = errors.New("The otpauth URL encoder is not supported, it must be steam")
+	URLIssuerMismatchError = errors.New("The otpauth URL issuer parameter differs from the issuer of the label")
+	urlProfileError        = errors.New("The otpauth URL profile is unknown")
+)
+
+// String returns the name of the authenticator app of the profile
+func (p URLProfile) String() string {
+	switch p {
+	case KeyURIProfile:
+		return "Key URI format"
+	case GoogleAuthenticatorProfile:
+		return "Google Authenticator"
+	case MicrosoftAuthenticatorProfile:
+		return "Microsoft Authenticator"
+	case FreeOTPProfile:
+		return "FreeOTP"
+	default:
+		return fmt.Sprintf("URLProfile(%d)", int(p))
+	}
+}
+
+// URLWarning describes a parameter of the Totp which is not going to work as expected in the app of the profile
+type URLWarning struct {
+	Parameter string // the otpauth URL parameter, for instance algorithm
+	Message   string // the reason
+}
+
+func (w URLWarning) String() string {
+	return fmt.Sprintf("%s: %s", w.Parameter, w.Message)
+}
+
+// URLCompatibilityError is returned by URLBuilder.Build, when FailOnWarnings is set and the Totp
+// has parameters that the app of the profile does not support
+type URLCompatibilityError struct {
+	Profile  URLProfile
+	Warnings []URLWarning
+}
+
+func (e *URLCompatibilityError) Error() string {
+	messages := make([]string, len(e.Warnings))
+	for i, w := range e.Warnings {
+		messages[i] = w.String()
+	}
+	return fmt.Sprintf("The TOTP is not compatible with %s: %s", e.Profile, strings.Join(messages, "; "))
+}
+
+// URLBuilder builds the otpauth URL of a Totp for a specific authenticator app
+type URLBuilder struct {
+	Profile        URLProfile // the authenticator app the URL is built for
+	Image          string     // optional URL of the image displayed next to the account (the image parameter), supported by FreeOTP
+	FailOnWarnings bool       // if true, the incompatibilities with the app are returned as URLCompatibilityError
+}
+
+// URL returns the otpauth URL of the Totp for the app of the profile
+// example: otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example&algorithm=SHA1&digits=6&period=30
+// The warnings list the parameters the app is going to ignore or refuse.
+func (otp *Totp) URL(profile URLProfile) (string, []URLWarning, error) {
+	return URLBuilder{Profile: profile}.Build(otp)
+}
+
+// Build returns the otpauth URL of the Totp, following the Key URI format
+// The issuer and the account are percent encoded, colons included, so that they can not alter the label.
+// The counter parameter is never added, because it's valid only for HOTP.
+// The Steam Guard codes are described by the encoder=steam parameter, the other alphabets can't be described by the URL.
+// The warnings list the parameters the app of the profile is going to ignore or refuse,
+// in that case the tokens generated by the app are not going to be accepted by the Totp.
+func (b URLBuilder) Build(otp *Totp) (string, []URLWarning, error) {
+
+	// verify the proper initialization
+	if err := totpHasBeenInitialized(otp); err != nil {
+		return "", nil, err
+	}
+
+	warnings, err := b.Profile.check(otp, b.Image)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if b.FailOnWarnings && len(warnings) > 0 {
+		return "", warnings, &URLCompatibilityError{Profile: b.Profile, Warnings: warnings}
+	}
+
+	// label
+	label := escapeLabelPart(otp.account)
+	if otp.issuer != "" {
+		label = escapeLabelPart(otp.issuer) + ":" + label
+	}
+
+	// the parameters are written in the order of the Key URI format documentation
+	parameters := []string{"secret=" + strings.TrimRight(otp.Secret(), "=")}
+	if otp.issuer != "" {
+		parameters = append(parameters, "issuer="+escapeParameter(otp.issuer))
+	}
+	parameters = append(parameters,
+		"algorithm="+algorithmName(otp.hashFunction),
+		"digits="+strconv.Itoa(otp.digits),
+		"period="+strconv.Itoa(otp.stepSize),
+	)
+	if encoder, _ := codeEncoder(otp.codeFormatter()); encoder != "" {
+		parameters = append(parameters, "encoder="+encoder)
+	}
+	if b.Image != "" {
+		parameters = append(parameters, "image="+escapeParameter(b.Image))
+	}
+
+	return "otpauth://totp/" + label + "?" + strings.Join(parameters, "&"), warnings, nil
+}
+
+// Private function which returns the parameters of the Totp that the app of the profile does not support
+func (p URLProfile) check(otp *Totp, image string) ([]URLWarning, error) {
+	var warnings []URLWarning
+
+	// only the decimal codes are checked against the digits supported by the app
+	encoder, described := codeEncoder(otp.codeFormatter())
+	decimal := described && encoder == ""
+	if !described {
+		warnings = append(warnings, URLWarning{"encoder", "the alphabet of the codes can't be described by the otpauth URL"})
+	}
+
+	switch p {
+	case KeyURIProfile:
+		if strings.Contains(otp.issuer, ":") {
+			warnings = append(warnings, URLWarning{"issuer", "the issuer must not contain a colon"})
+		}
+		if strings.Contains(otp.account, ":") {
+			warnings = append(warnings, URLWarning{"label", "the account name must not contain a colon"})
+		}
+		if otp.issuer == "" {
+			warnings = append(warnings, URLWarning{"issuer", "the issuer parameter is strongly recommended"})
+		}
+		if decimal && otp.digits != 6 && otp.digits != 8 {
+			warnings = append(warnings, URLWarning{"digits", "the digits must be 6 or 8"})
+		}
+		if encoder != "" {
+			warnings = append(warnings, URLWarning{"encoder", "the encoder parameter is an extension of the Key URI format, supported only by some apps"})
+		}
+	case GoogleAuthenticatorProfile, MicrosoftAuthenticatorProfile:
+		if otp.hashFunction != crypto.SHA1 {
+			warnings = append(warnings, URLWarning{"algorithm", fmt.Sprintf("%s is ignored, the app uses SHA1", algorithmName(otp.hashFunction))})
+		}
+		if decimal && otp.digits != 6 {
+			warnings = append(warnings, URLWarning{"digits", fmt.Sprintf("%d digits are ignored, the app uses 6 digits", otp.digits)})
+		}
+		if encoder != "" {
+			warnings = append(warnings, URLWarning{"encoder", "the app generates only decimal codes"})
+		}
+		if otp.stepSize != step_size {
+			warnings = append(warnings, URLWarning{"period", fmt.Sprintf("%d seconds are ignored, the app uses 30 seconds", otp.stepSize)})
+		}
+		if image != "" {
+			warnings = append(warnings, URLWarning{"image", "the image is ignored"})
+		}
+	case FreeOTPProfile:
+		if decimal && otp.digits != 6 && otp.digits != 8 {
+			warnings = append(warnings, URLWarning{"digits", "the app supports only 6 or 8 digits"})
+		}
+		if encoder != "" {
+			warnings = append(warnings, URLWarning{"encoder", "the app generates only decimal codes"})
+		}
+	default:
+		return nil, urlProfileError
+	}
+
+	return warnings, nil
+}
+
+// Private function which percent encodes the issuer or the account in the label
+// The colon is encoded as well, because it separates the issuer from the account
+func escapeLabelPart(s string) string {
+	return strings.Replace(url.PathEscape(s), ":", "%3A", -1)
+}
+
+// Private function which percent encodes a parameter value
+// The spaces are encoded as %20 and not as +, as required by the Key URI format
+func escapeParameter(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// TOTPFromURL creates a TOTP object from an otpauth URL, as exported by the authenticator apps or by other 2FA systems
+// example: otpauth://totp/Example:alice@google.com?secret=JBSWY3DPEHPK3PXP&issuer=Example
+// The label, the issuer, the base32 secret (with or without padding), the algorithm, the digits and the period are decoded.
+// The missing parameters get the default values of the Key URI format: SHA1, 6 digits and 30 seconds.
+// The encoder=steam parameter selects the Steam Guard codes, in that case the digits parameter is ignored.
+// The options, for instance WithClock, are applied after the URL parameters.
+// For each malformed or unsupported parameter a specific error is returned, for instance URLSecretError.
+func TOTPFromURL(uri string, options ...TotpOption) (*Totp, error) {
+
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return nil, URLParsingError
+	}
+
+	if !strings.EqualFold(u.Scheme, "otpauth") {
+		return nil, URLSchemeError
+	}
+
+	if !strings.EqualFold(u.Host, "totp") {
+		return nil, URLTypeError
+	}
+
+	// the label is either issuer:account or only the account
+	// the escaped path is used, so that an encoded colon in the issuer or in the account does not split the label
+	issuer, account, err := parseLabel(strings.TrimPrefix(u.EscapedPath(), "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	v := u.Query()
+
+	// the issuer parameter is the recommended one, the label prefix must match it if both are present
+	if issuerParam := v.Get("issuer"); issuerParam != "" {
+		if issuer != "" && issuer != issuerParam {
+			// the URL generated by the previous versions of this package had the label issuer query escaped
+			if unescaped, err := url.QueryUnescape(issuer); err != nil || unescaped != issuerParam {
+				return nil, URLIssuerMismatchError
+			}
+		}
+		issuer = issuerParam
+	}
+
+	key, err := decodeSecret(v.Get("secret"))
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := parseAlgorithm(v.Get("algorithm"))
+	if err != nil {
+		return nil, err
+	}
+
+	var formatter CodeFormatter
+	switch strings.ToLower(v.Get("encoder")) {
+	case "":
+	case steam_encoder:
+		formatter = NewSteamGuardFormatter()
+	default:
+		return nil, URLEncoderError
+	}
+
+	digits := 6
+	if d := v.Get("digits"); d != "" && formatter == nil {
+		digits, err = strconv.Atoi(d)
+		if err != nil || digits < 6 || digits > 8 {
+			return nil, URLDigitsError
+		}
+	}
+
+	otp, err := makeTOTP(key, account, issuer, hash, digits)
+	if err != nil {
+		return nil, err
+	}
+
+	if formatter != nil {
+		if err := WithCodeFormatter(formatter)(otp); err != nil {
+			return nil, err
+		}
+	}
+
+	if p := v.Get("period"); p != "" {
+		period, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, URLPeriodError
+		}
+		if err := WithPeriod(period)(otp); err != nil {
+			return nil, URLPeriodError
+		}
+	}
+
+	if err := applyTotpOptions(otp, options); err != nil {
+		return nil, err
+	}
+
+	return otp, nil
+}
+
+// Private function which splits the escaped label in issuer and account and decodes them
+// The issuer prefix is optional and it may be followed by spaces: "Example: alice@google.com"
+func parseLabel(label string) (string, string, error) {
+	issuer := ""
+	account := label
+	if index := strings.Index(label, ":"); index >= 0 {
+		issuer = label[:index]
+		account = label[index+1:]
+	}
+
+	issuer, err := url.PathUnescape(issuer)
+	if err != nil {
+		return "", "", URLParsingError
+	}
+	account, err = url.PathUnescape(account)
+	if err != nil {
+		return "", "", URLParsingError
+	}
+
+	account = strings.TrimSpace(account)
+	if account == "" {
+		return "", "", URLLabelError
+	}
+	return strings.TrimSpace(issuer), account, nil
+}
+
+// Private function which decodes the base32 secret
+// The authenticator apps usually omit the padding, accept lower case letters and spaces
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+	if secret == "" {
+		return nil, URLSecretError
+	}
+	if padding := len(secret) % 8; padding != 0 {
+		secret += strings.Repeat("=", 8-padding)
+	}
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, URLSecretError
+	}
+	return key, nil
+}
+
+// Private function which returns the hash function of the algorithm parameter
+// The parameter is optional, SHA1 is the default
+func parseAlgorithm(algorithm string) (crypto.Hash, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", "SHA1":
+		return crypto.SHA1, nil
+	case "SHA256":
+		return crypto.SHA256, nil
+	case "SHA512":
+		return crypto.SHA512, nil
+	default:
+		return crypto.SHA1, URLAlgorithmError
+	}
+}
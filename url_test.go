@@ -0,0 +1,200 @@
+package twofactor
+
+import (
+	"crypto"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPFromURL(t *testing.T) {
+
+	otp, err := TOTPFromURL("otpauth://totp/ACME%20Co:john.doe@email.com?secret=HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ&issuer=ACME%20Co&algorithm=SHA256&digits=7&period=60")
+	checkError(t, err)
+
+	if otp.issuer != "ACME Co" {
+		t.Errorf("Expected the issuer ACME Co, instead we've got %s\n", otp.issuer)
+	}
+	if otp.account != "john.doe@email.com" {
+		t.Errorf("Expected the account john.doe@email.com, instead we've got %s\n", otp.account)
+	}
+	if otp.Secret() != "HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ" {
+		t.Errorf("Unexpected secret %s\n", otp.Secret())
+	}
+	if otp.hashFunction != crypto.SHA256 {
+		t.Error("Expected the SHA256 hash function")
+	}
+	if otp.digits != 7 {
+		t.Errorf("Expected 7 digits, instead we've got %d\n", otp.digits)
+	}
+	if otp.stepSize != 60 {
+		t.Errorf("Expected a period of 60 seconds, instead we've got %d\n", otp.stepSize)
+	}
+
+	// defaults of the Key URI format, unpadded and lower case secret, no issuer
+	otp, err = TOTPFromURL("otpauth://totp/alice@google.com?secret=jbswy3dpeb3w64tmmq")
+	checkError(t, err)
+	if otp.issuer != "" || otp.account != "alice@google.com" {
+		t.Errorf("Unexpected label %s\n", otp.label())
+	}
+	if otp.digits != 6 || otp.stepSize != 30 || otp.hashFunction != crypto.SHA1 {
+		t.Error("The defaults of the Key URI format have not been applied")
+	}
+	if otp.Secret() != "JBSWY3DPEB3W64TMMQ======" {
+		t.Errorf("Unexpected secret %s\n", otp.Secret())
+	}
+
+	// the issuer of the label is used when the parameter is missing, the options are applied
+	clock := &fakeClock{now: time.Unix(1234567890, 0)}
+	otp, err = TOTPFromURL("otpauth://totp/Example: alice@google.com?secret=JBSWY3DPEHPK3PXP%3D%3D%3D", WithClock(clock))
+	checkError(t, err)
+	if otp.issuer != "Example" || otp.account != "alice@google.com" {
+		t.Errorf("Unexpected label %s\n", otp.label())
+	}
+	if otp.clock != clock {
+		t.Error("The options have not been applied")
+	}
+
+}
+
+func TestTOTPFromURLRoundTrip(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA512, 8, WithPeriod(45))
+	checkError(t, err)
+
+	u, err := otp.url()
+	checkError(t, err)
+
+	parsed, err := TOTPFromURL(u)
+	checkError(t, err)
+
+	if parsed.Secret() != otp.Secret() || parsed.label() != otp.label() || parsed.digits != otp.digits ||
+		parsed.stepSize != otp.stepSize || parsed.hashFunction != otp.hashFunction {
+		t.Errorf("The parsed TOTP differs from the original: %s\n", u)
+	}
+
+	now := time.Now()
+	expected, err := otp.OTPAt(now)
+	checkError(t, err)
+	token, err := parsed.OTPAt(now)
+	checkError(t, err)
+	if token != expected {
+		t.Error("The parsed TOTP generates different tokens")
+	}
+
+}
+
+func TestTOTPFromURLErrors(t *testing.T) {
+
+	tests := []struct {
+		uri string
+		err error
+	}{
+		{"otpauth://totp/%zz?secret=JBSWY3DPEHPK3PXP", URLParsingError},
+		{"https://totp/Example:alice?secret=JBSWY3DPEHPK3PXP", URLSchemeError},
+		{"otpauth://hotp/Example:alice?secret=JBSWY3DPEHPK3PXP&counter=0", URLTypeError},
+		{"otpauth://totp/Example:?secret=JBSWY3DPEHPK3PXP", URLLabelError},
+		{"otpauth://totp/?secret=JBSWY3DPEHPK3PXP", URLLabelError},
+		{"otpauth://totp/Example:alice", URLSecretError},
+		{"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PX1", URLSecretError},
+		{"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&algorithm=MD5", URLAlgorithmError},
+		{"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&digits=5", URLDigitsError},
+		{"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&digits=six", URLDigitsError},
+		{"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&period=0", URLPeriodError},
+		{"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&period=1h", URLPeriodError},
+		{"otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&issuer=Other", URLIssuerMismatchError},
+	}
+
+	for _, test := range tests {
+		if _, err := TOTPFromURL(test.uri); err != test.err {
+			t.Errorf("%s: expected the error %q, instead we've got %v\n", test.uri, test.err, err)
+		}
+	}
+
+}
+
+func TestURLBuilder(t *testing.T) {
+
+	key, err := hex.DecodeString(sha1KeyHex)
+	checkError(t, err)
+
+	otp, err := makeTOTP(key, "john:doe@email.com", "ACME Co: Inc", crypto.SHA1, 6)
+	checkError(t, err)
+
+	u, warnings, err := URLBuilder{Profile: FreeOTPProfile, Image: "https://example.com/logo.png"}.Build(otp)
+	checkError(t, err)
+	expected := "otpauth://totp/ACME%20Co%3A%20Inc:john%3Adoe@email.com?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&issuer=ACME%20Co%3A%20Inc&algorithm=SHA1&digits=6&period=30&image=https%3A%2F%2Fexample.com%2Flogo.png"
+	if u != expected {
+		t.Errorf("Unexpected URL:\n%s\nexpected:\n%s\n", u, expected)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Unexpected warnings: %v\n", warnings)
+	}
+	if strings.Contains(u, "counter=") {
+		t.Error("The TOTP URL contains the counter parameter")
+	}
+
+	// the escaped colons survive the parsing
+	parsed, err := TOTPFromURL(u)
+	checkError(t, err)
+	if parsed.issuer != otp.issuer || parsed.account != otp.account {
+		t.Errorf("Unexpected label after parsing: %s - %s\n", parsed.issuer, parsed.account)
+	}
+
+	// the strict profile warns about the colons
+	_, warnings, err = otp.URL(KeyURIProfile)
+	checkError(t, err)
+	if len(warnings) != 2 {
+		t.Errorf("Expected 2 warnings, instead we've got: %v\n", warnings)
+	}
+
+}
+
+func TestURLProfiles(t *testing.T) {
+
+	otp, err := NewTOTP("info@sec51.com", "Sec51", crypto.SHA256, 8, WithPeriod(60))
+	checkError(t, err)
+
+	tests := []struct {
+		profile  URLProfile
+		warnings []string
+	}{
+		{KeyURIProfile, nil},
+		{GoogleAuthenticatorProfile, []string{"algorithm", "digits", "period"}},
+		{MicrosoftAuthenticatorProfile, []string{"algorithm", "digits", "period"}},
+		{FreeOTPProfile, nil},
+	}
+
+	for _, test := range tests {
+		_, warnings, err := otp.URL(test.profile)
+		checkError(t, err)
+		if len(warnings) != len(test.warnings) {
+			t.Errorf("%s: expected the warnings %v, instead we've got %v\n", test.profile, test.warnings, warnings)
+			continue
+		}
+		for i, w := range warnings {
+			if w.Parameter != test.warnings[i] {
+				t.Errorf("%s: expected the warning on %s, instead we've got %s\n", test.profile, test.warnings[i], w)
+			}
+		}
+
+		// fail instead of warning
+		_, _, err = URLBuilder{Profile: test.profile, FailOnWarnings: true}.Build(otp)
+		if len(test.warnings) == 0 && err != nil {
+			t.Errorf("%s: unexpected error %v\n", test.profile, err)
+		}
+		if _, ok := err.(*URLCompatibilityError); len(test.warnings) > 0 && !ok {
+			t.Errorf("%s: expected the compatibility error, instead we've got %v\n", test.profile, err)
+		}
+	}
+
+	if _, _, err := otp.URL(URLProfile(42)); err == nil {
+		t.Error("An unknown profile has been accepted")
+	}
+
+	if _, _, err := (&Totp{}).URL(GoogleAuthenticatorProfile); err == nil {
+		t.Fatal("Totp is not properly initialized and the method did not catch it")
+	}
+
+}